@@ -0,0 +1,397 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/projectcalico/libcalico-go/lib/api"
+
+	"github.com/projectcalico/libnetwork-plugin/driver"
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	osutils "github.com/projectcalico/libnetwork-plugin/utils/os"
+)
+
+// FileEnv names the config file when -config isn't given.
+const FileEnv = "CALICO_LIBNETWORK_CONFIG"
+
+// envPrefix starts the environment variable of each setting, which is followed
+// by its flag name in upper case with "_" for "-", e.g.
+// CALICO_LIBNETWORK_LOG_LEVEL for -log-level.
+const envPrefix = "CALICO_LIBNETWORK_"
+
+// Interface names are at most 15 bytes, and Docker adds a number to the prefix
+// to name each container's interface.
+const maxInterfacePrefixLen = 12
+
+// Config holds every setting of the plugin.  Each setting is taken from the
+// first of these that sets it:
+//
+//  1. its command line flag
+//  2. its environment variable, see EnvName
+//  3. the YAML config file given by -config or CALICO_LIBNETWORK_CONFIG
+//  4. its default
+type Config struct {
+	// Names the network and IPAM drivers are registered with Docker under,
+	// and the directory and group of their sockets.  Docker only looks for
+	// sockets in /run/docker/plugins.
+	NetworkPluginName string `json:"networkPluginName"`
+	IPAMPluginName    string `json:"ipamPluginName"`
+	SocketDir         string `json:"socketDir"`
+	SocketGroup       string `json:"socketGroup"`
+
+	// Which of the drivers are served.  With only the network driver, other
+	// IPAM drivers can be used for its networks.
+	EnableNetworkDriver bool `json:"enableNetworkDriver"`
+	EnableIPAMDriver    bool `json:"enableIPAMDriver"`
+
+	// Managed is set when running as a Docker managed plugin, which has a
+	// single socket that both drivers are served on: the network driver's.
+	Managed bool `json:"managed"`
+
+	// Hostname is the node endpoints are created on.  If it isn't set,
+	// $NODENAME, the contents of NodenameFile, $HOSTNAME or else the name of
+	// the host is used, so that it matches the name calico/node registered.
+	Hostname     string `json:"hostname"`
+	NodenameFile string `json:"nodenameFile"`
+
+	InterfacePrefix string   `json:"interfacePrefix"`
+	DockerFallback  string   `json:"dockerFallback"`
+	MACAddress      string   `json:"macAddress"`
+	GatewayIPv4     string   `json:"gatewayIPv4"`
+	OrchestratorID  string   `json:"orchestratorID"`
+	WorkloadID      string   `json:"workloadID"`
+	RPCTimeout      Duration `json:"rpcTimeout"`
+
+	// The traffic allowed by the profile created for each new network.
+	ProfileIngress string `json:"profileIngress"`
+	ProfileEgress  string `json:"profileEgress"`
+
+	// When endpoints that Docker no longer knows about are removed.
+	OrphanGracePeriod   Duration `json:"orphanGracePeriod"`
+	OrphanSweepDelay    Duration `json:"orphanSweepDelay"`
+	OrphanSweepInterval Duration `json:"orphanSweepInterval"`
+
+	RetryQueue string `json:"retryQueue"`
+	HTTPAddr   string `json:"httpAddr"`
+	AuditLog   string `json:"auditLog"`
+
+	Datastore Datastore `json:"datastore"`
+	TCP       TCP       `json:"tcp"`
+	Log       Log       `json:"log"`
+	Debug     Debug     `json:"debug"`
+}
+
+// TCP holds the settings for serving the drivers on TCP, with mutual TLS,
+// instead of on unix sockets.  A driver is only served on TCP if its address
+// is set.
+type TCP struct {
+	NetworkAddr string `json:"networkAddr"`
+	IPAMAddr    string `json:"ipamAddr"`
+
+	// The plugin's certificate, and the CA that Docker's certificate must be
+	// signed by.
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"`
+
+	// SpecDir is where the discovery files telling Docker the addresses are
+	// written.  AdvertiseHost is the host Docker should connect to, if not the
+	// one listened on.
+	SpecDir       string `json:"specDir"`
+	AdvertiseHost string `json:"advertiseHost"`
+
+	// The files Docker uses to verify the plugin's certificate and to
+	// identify itself, as Docker sees them, which are written to the
+	// discovery files.
+	DockerCAFile   string `json:"dockerCAFile"`
+	DockerCertFile string `json:"dockerCertFile"`
+	DockerKeyFile  string `json:"dockerKeyFile"`
+}
+
+// Log holds the logging settings.
+type Log struct {
+	Level         string            `json:"level"`
+	Levels        map[string]string `json:"levels"`
+	Format        string            `json:"format"`
+	File          string            `json:"file"`
+	MaxSizeMB     int               `json:"maxSizeMB"`
+	MaxBackups    int               `json:"maxBackups"`
+	MaxJSONLength int               `json:"maxJSONLength"`
+	RedactKeys    []string          `json:"redactKeys"`
+}
+
+// Debug holds the settings for investigating problems with the plugin.
+type Debug struct {
+	Listen             string              `json:"listen"`
+	TraceFile          string              `json:"traceFile"`
+	TraceEndpoint      string              `json:"traceEndpoint"`
+	SlowCallThreshold  Duration            `json:"slowCallThreshold"`
+	SlowCallThresholds map[string]Duration `json:"slowCallThresholds"`
+}
+
+// Duration is a time.Duration written as a string such as "25s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Errorf("Invalid duration %s, expected e.g. \"25s\"", data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid duration %q", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Defaults returns the settings used when nothing else is configured.
+func Defaults() *Config {
+	d := driver.DefaultConfig()
+	return &Config{
+		NetworkPluginName: "calico",
+		IPAMPluginName:    "calico-ipam",
+		SocketDir:         "/run/docker/plugins",
+		SocketGroup:       "root",
+
+		EnableNetworkDriver: true,
+		EnableIPAMDriver:    true,
+
+		NodenameFile: osutils.DefaultNodenameFile,
+
+		InterfacePrefix: d.InterfacePrefix,
+		DockerFallback:  d.DockerFallback,
+		MACAddress:      d.MACAddress,
+		GatewayIPv4:     d.GatewayIPv4,
+		OrchestratorID:  d.OrchestratorID,
+		WorkloadID:      d.WorkloadID,
+		RPCTimeout:      Duration(d.RPCTimeout),
+
+		ProfileIngress: d.ProfileIngress,
+		ProfileEgress:  d.ProfileEgress,
+
+		OrphanGracePeriod:   Duration(d.OrphanGracePeriod),
+		OrphanSweepDelay:    Duration(d.OrphanSweepDelay),
+		OrphanSweepInterval: Duration(d.OrphanSweepInterval),
+
+		RetryQueue: "/var/lib/calico/libnetwork-retry-queue.json",
+
+		Datastore: Datastore{
+			LocalFile:    "/var/lib/calico/libnetwork-datastore.json",
+			LocalIPPools: []string{"192.168.0.0/16"},
+		},
+
+		TCP: TCP{
+			SpecDir: "/etc/docker/plugins",
+		},
+
+		Log: Log{
+			Level:         "info",
+			Format:        "text",
+			MaxSizeMB:     100,
+			MaxBackups:    5,
+			MaxJSONLength: logutils.DefaultMaxJSONLength,
+		},
+		Debug: Debug{
+			// Docker gives up on plugin calls after its own timeouts, so warn
+			// about calls well before they get near them.
+			SlowCallThreshold: Duration(10 * time.Second),
+		},
+	}
+}
+
+// EnvName returns the environment variable that sets the setting with the
+// given flag name.
+func EnvName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Load returns the defaults, overridden by the config file at path if it isn't
+// empty, then by the environment.
+func Load(path string) (*Config, error) {
+	c := Defaults()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Config file %v reading error", path)
+		}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, errors.Wrapf(err, "Config file %v parsing error", path)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv applies the environment variables of the settings that are set and
+// not empty, as Docker managed plugins declare every variable they can be
+// configured with, even those with no value.
+func (c *Config) applyEnv() error {
+	// These were read before every setting had an environment variable.
+	if prefix := os.Getenv("CALICO_LIBNETWORK_IFPREFIX"); prefix != "" {
+		c.InterfacePrefix = prefix
+	}
+	if os.Getenv("CALICO_DEBUG") != "" {
+		c.Log.Level = "debug"
+	}
+
+	var err error
+	flagSet := flag.NewFlagSet("", flag.ContinueOnError)
+	bind(flagSet, c)
+	flagSet.VisitAll(func(fl *flag.Flag) {
+		name := EnvName(fl.Name)
+		if value := os.Getenv(name); err == nil && value != "" {
+			if setErr := flagSet.Set(fl.Name, value); setErr != nil {
+				err = errors.Wrapf(setErr, "Invalid %v value %q", name, value)
+			}
+		}
+	})
+	return err
+}
+
+// Validate checks the settings that can't be used as they are.
+func (c *Config) Validate() error {
+	for _, name := range []string{c.NetworkPluginName, c.IPAMPluginName} {
+		if name == "" || strings.Contains(name, "/") {
+			return errors.Errorf("Invalid plugin name %q", name)
+		}
+	}
+	if !c.EnableNetworkDriver && !c.EnableIPAMDriver {
+		return errors.New("Neither the network nor the IPAM driver is enabled")
+	}
+	if c.Managed && (!c.EnableNetworkDriver || !c.EnableIPAMDriver) {
+		// Its config.json declares both, so Docker would send it requests for
+		// a driver that isn't there.
+		return errors.New("A managed plugin must serve both the network and the IPAM driver")
+	}
+	if c.NetworkPluginName == c.IPAMPluginName {
+		return errors.Errorf("The network and IPAM plugins can't both be named %q", c.NetworkPluginName)
+	}
+	switch api.DatastoreType(c.Datastore.Type) {
+	case "", api.EtcdV2, api.Kubernetes, DatastoreLocal:
+	default:
+		return errors.Errorf("Invalid datastore type %q, expected %v, %v or %v", c.Datastore.Type, api.EtcdV2, api.Kubernetes, DatastoreLocal)
+	}
+	if _, err := c.localIPPools(); err != nil {
+		return err
+	}
+	switch c.DockerFallback {
+	case driver.DockerFallbackError, driver.DockerFallbackNetworkID:
+	default:
+		return errors.Errorf("Invalid Docker fallback %q, expected %v or %v", c.DockerFallback, driver.DockerFallbackError, driver.DockerFallbackNetworkID)
+	}
+	if c.InterfacePrefix == "" || len(c.InterfacePrefix) > maxInterfacePrefixLen || strings.ContainsAny(c.InterfacePrefix, "/: \t\n") {
+		return errors.Errorf("Invalid interface prefix %q, expected at most %v characters without whitespace, \"/\" or \":\"", c.InterfacePrefix, maxInterfacePrefixLen)
+	}
+	if mac, err := net.ParseMAC(c.MACAddress); err != nil || len(mac) != 6 {
+		return errors.Errorf("Invalid MAC address %q, expected e.g. %q", c.MACAddress, driver.DefaultConfig().MACAddress)
+	}
+	if ip := net.ParseIP(c.GatewayIPv4); ip == nil || ip.To4() == nil {
+		return errors.Errorf("Invalid IPv4 gateway %q, expected e.g. %q", c.GatewayIPv4, driver.DefaultConfig().GatewayIPv4)
+	}
+	if c.TCP.NetworkAddr != "" || c.TCP.IPAMAddr != "" {
+		if c.Managed {
+			return errors.New("A managed plugin can only be served on the socket Docker gives it, not on TCP")
+		}
+		if c.TCP.NetworkAddr == c.TCP.IPAMAddr {
+			return errors.Errorf("The network and IPAM drivers can't both be served on %v", c.TCP.NetworkAddr)
+		}
+		for _, file := range []struct{ flag, path string }{
+			{"tcp-cert-file", c.TCP.CertFile},
+			{"tcp-key-file", c.TCP.KeyFile},
+			{"tcp-client-ca-file", c.TCP.ClientCAFile},
+			{"tcp-docker-ca-file", c.TCP.DockerCAFile},
+			{"tcp-docker-cert-file", c.TCP.DockerCertFile},
+			{"tcp-docker-key-file", c.TCP.DockerKeyFile},
+		} {
+			if file.path == "" {
+				return errors.Errorf("Serving on TCP requires mutual TLS, but -%v isn't set", file.flag)
+			}
+		}
+	}
+	if c.RPCTimeout <= 0 {
+		return errors.Errorf("Invalid RPC timeout %v, expected a positive duration", time.Duration(c.RPCTimeout))
+	}
+	switch c.ProfileIngress {
+	case driver.ProfileIngressNetwork, driver.ProfileAll, driver.ProfileNone:
+	default:
+		return errors.Errorf("Invalid profile ingress %q, expected %v, %v or %v", c.ProfileIngress, driver.ProfileIngressNetwork, driver.ProfileAll, driver.ProfileNone)
+	}
+	switch c.ProfileEgress {
+	case driver.ProfileAll, driver.ProfileNone:
+	default:
+		return errors.Errorf("Invalid profile egress %q, expected %v or %v", c.ProfileEgress, driver.ProfileAll, driver.ProfileNone)
+	}
+	if c.OrphanGracePeriod < 0 || c.OrphanSweepDelay < 0 {
+		return errors.New("Invalid orphaned endpoint grace period or sweep delay, expected a duration that isn't negative")
+	}
+	if c.OrphanSweepInterval <= 0 {
+		return errors.Errorf("Invalid orphaned endpoint sweep interval %v, expected a positive duration", time.Duration(c.OrphanSweepInterval))
+	}
+	return nil
+}
+
+// NodeName resolves the name of the node that endpoints are created on,
+// returning it and where it came from.
+func (c *Config) NodeName() (string, string, error) {
+	return osutils.NodeName(c.Hostname, c.NodenameFile)
+}
+
+// Driver returns the settings of the network and IPAM drivers, which create
+// endpoints on the given node.
+func (c *Config) Driver(nodeName string) driver.Config {
+	return driver.Config{
+		NodeName:        nodeName,
+		InterfacePrefix: c.InterfacePrefix,
+		DockerFallback:  c.DockerFallback,
+		MACAddress:      c.MACAddress,
+		GatewayIPv4:     c.GatewayIPv4,
+		AllowOtherIPAM:  !c.EnableIPAMDriver,
+		OrchestratorID:  c.OrchestratorID,
+		WorkloadID:      c.WorkloadID,
+		RPCTimeout:      time.Duration(c.RPCTimeout),
+
+		ProfileIngress: c.ProfileIngress,
+		ProfileEgress:  c.ProfileEgress,
+
+		OrphanGracePeriod:   time.Duration(c.OrphanGracePeriod),
+		OrphanSweepDelay:    time.Duration(c.OrphanSweepDelay),
+		OrphanSweepInterval: time.Duration(c.OrphanSweepInterval),
+	}
+}
+
+// Logging returns the logging settings.
+func (c *Config) Logging() logutils.Config {
+	return logutils.Config{
+		Level:           c.Log.Level,
+		SubsystemLevels: c.Log.Levels,
+		Format:          c.Log.Format,
+		File:            c.Log.File,
+		MaxSizeMB:       c.Log.MaxSizeMB,
+		MaxBackups:      c.Log.MaxBackups,
+		MaxJSONLength:   c.Log.MaxJSONLength,
+		RedactKeys:      c.Log.RedactKeys,
+	}
+}
+
+// SlowCallThresholds returns the thresholds for individual driver methods.
+func (c *Config) SlowCallThresholds() map[string]time.Duration {
+	thresholds := map[string]time.Duration{}
+	for method, threshold := range c.Debug.SlowCallThresholds {
+		thresholds[method] = time.Duration(threshold)
+	}
+	return thresholds
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libnetwork-plugin/driver"
+)
+
+var _ = Describe("Config", func() {
+	var dir, file string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "libnetwork-plugin.yaml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		os.Unsetenv("CALICO_LIBNETWORK_IFPREFIX")
+		os.Unsetenv("CALICO_LIBNETWORK_RPC_TIMEOUT")
+		os.Unsetenv("CALICO_DEBUG")
+		os.Unsetenv("CALICO_LIBNETWORK_INTERFACE_PREFIX")
+		os.Unsetenv("CALICO_LIBNETWORK_HOSTNAME")
+		os.Unsetenv("CALICO_LIBNETWORK_MANAGED")
+		os.Unsetenv("CALICO_LIBNETWORK_LOG_REDACT_KEYS")
+	})
+
+	write := func(yaml string) {
+		Expect(ioutil.WriteFile(file, []byte(yaml), 0600)).To(Succeed())
+	}
+
+	// load parses the flags given and loads the config.
+	load := func(args ...string) (*Config, error) {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(flagSet)
+		Expect(flagSet.Parse(args)).To(Succeed())
+		return flags.Load()
+	}
+
+	It("uses the defaults when nothing is configured", func() {
+		c, err := load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(Defaults()))
+		Expect(c.Driver("")).To(Equal(driver.DefaultConfig()))
+	})
+
+	It("reads settings from the config file", func() {
+		write(`
+interfacePrefix: tap
+rpcTimeout: 10s
+hostname: node1
+log:
+  level: debug
+  levels:
+    netns: trace
+  redactKeys: [password]
+debug:
+  slowCallThresholds:
+    network.Join: 2s
+`)
+		c, err := load("-config", file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.InterfacePrefix).To(Equal("tap"))
+		Expect(c.Driver("node1").RPCTimeout).To(Equal(10 * time.Second))
+		Expect(c.Driver("node1").NodeName).To(Equal("node1"))
+		nodeName, source, err := c.NodeName()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodeName).To(Equal("node1"))
+		Expect(source).To(Equal("configuration"))
+		Expect(c.Log.Level).To(Equal("debug"))
+		Expect(c.Log.Levels).To(Equal(map[string]string{"netns": "trace"}))
+		Expect(c.Log.RedactKeys).To(Equal([]string{"password"}))
+		Expect(c.SlowCallThresholds()).To(Equal(map[string]time.Duration{"network.Join": 2 * time.Second}))
+
+		// Settings that aren't in the file keep their defaults.
+		Expect(c.MACAddress).To(Equal(Defaults().MACAddress))
+	})
+
+	It("overrides the config file with the environment, and both with flags", func() {
+		write("interfacePrefix: tap\nrpcTimeout: 10s\nlog:\n  level: warning\n")
+		os.Setenv("CALICO_LIBNETWORK_IFPREFIX", "env")
+		os.Setenv("CALICO_LIBNETWORK_RPC_TIMEOUT", "20s")
+		os.Setenv("CALICO_DEBUG", "true")
+
+		c, err := load("-config", file, "-rpc-timeout", "30s", "-log-levels", "ipam=trace")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.InterfacePrefix).To(Equal("env"))
+		Expect(c.RPCTimeout).To(Equal(Duration(30 * time.Second)))
+		Expect(c.Log.Level).To(Equal("debug"))
+		Expect(c.Log.Levels).To(Equal(map[string]string{"ipam": "trace"}))
+	})
+
+	It("reads every setting from its environment variable, ignoring empty ones", func() {
+		write("hostname: file\n")
+		os.Setenv("CALICO_LIBNETWORK_IFPREFIX", "legacy")
+		os.Setenv("CALICO_LIBNETWORK_INTERFACE_PREFIX", "tap")
+		os.Setenv("CALICO_LIBNETWORK_HOSTNAME", "")
+		os.Setenv("CALICO_LIBNETWORK_MANAGED", "true")
+		os.Setenv("CALICO_LIBNETWORK_LOG_REDACT_KEYS", "password,token")
+
+		c, err := load("-config", file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.InterfacePrefix).To(Equal("tap"))
+		Expect(c.Hostname).To(Equal("file"))
+		Expect(c.Managed).To(BeTrue())
+		Expect(c.Log.RedactKeys).To(Equal([]string{"password", "token"}))
+		Expect(EnvName("log-level")).To(Equal("CALICO_LIBNETWORK_LOG_LEVEL"))
+	})
+
+	It("allows other IPAM drivers when only the network driver is enabled", func() {
+		c, err := load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Driver("").AllowOtherIPAM).To(BeFalse())
+
+		c, err = load("-enable-ipam-driver=false")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.EnableNetworkDriver).To(BeTrue())
+		Expect(c.Driver("").AllowOtherIPAM).To(BeTrue())
+	})
+
+	It("applies flags that aren't single values", func() {
+		c, err := load("-log-redact-keys", "password, token,", "-slow-call-thresholds", "ipam.RequestAddress=250ms")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Log.RedactKeys).To(Equal([]string{"password", "token"}))
+		Expect(c.Debug.SlowCallThresholds).To(Equal(map[string]Duration{"ipam.RequestAddress": Duration(250 * time.Millisecond)}))
+	})
+
+	It("rejects invalid settings", func() {
+		write("rpcTimeout: 10\n")
+		_, err := load("-config", file)
+		Expect(err).To(MatchError(ContainSubstring("Invalid duration 10")))
+
+		_, err = load("-docker-fallback", "ignore")
+		Expect(err).To(MatchError(ContainSubstring("Invalid Docker fallback")))
+
+		_, err = load("-interface-prefix", "container-eth")
+		Expect(err).To(MatchError(ContainSubstring("Invalid interface prefix")))
+
+		_, err = load("-mac-address", "EE:EE:EE:EE:EE")
+		Expect(err).To(MatchError(ContainSubstring("Invalid MAC address")))
+
+		_, err = load("-gateway-ipv4", "fe80::1")
+		Expect(err).To(MatchError(ContainSubstring("Invalid IPv4 gateway")))
+
+		_, err = load("-enable-network-driver=false", "-enable-ipam-driver=false")
+		Expect(err).To(MatchError(ContainSubstring("Neither the network nor the IPAM driver is enabled")))
+
+		_, err = load("-managed", "-enable-ipam-driver=false")
+		Expect(err).To(MatchError(ContainSubstring("A managed plugin must serve both")))
+
+		_, err = load("-ipam-plugin-name", "calico")
+		Expect(err).To(MatchError(ContainSubstring("can't both be named")))
+
+		_, err = load("-network-plugin-name", "../calico")
+		Expect(err).To(MatchError(ContainSubstring("Invalid plugin name")))
+
+		_, err = load("-tcp-network-addr", ":9200", "-tcp-ipam-addr", ":9200")
+		Expect(err).To(MatchError(ContainSubstring("can't both be served on")))
+
+		_, err = load("-tcp-network-addr", ":9200", "-tcp-cert-file", "/plugin.crt")
+		Expect(err).To(MatchError(ContainSubstring("-tcp-key-file isn't set")))
+
+		_, err = load("-managed", "-tcp-network-addr", ":9200")
+		Expect(err).To(MatchError(ContainSubstring("A managed plugin can only be served on the socket")))
+
+		os.Setenv("CALICO_LIBNETWORK_MANAGED", "sometimes")
+		_, err = load()
+		Expect(err).To(MatchError(ContainSubstring("Invalid CALICO_LIBNETWORK_MANAGED value")))
+		os.Unsetenv("CALICO_LIBNETWORK_MANAGED")
+
+		_, err = load("-rpc-timeout", "0s")
+		Expect(err).To(MatchError(ContainSubstring("Invalid RPC timeout")))
+
+		_, err = load("-profile-ingress", "tag")
+		Expect(err).To(MatchError(ContainSubstring("Invalid profile ingress")))
+
+		_, err = load("-orphan-sweep-interval", "0s")
+		Expect(err).To(MatchError(ContainSubstring("Invalid orphaned endpoint sweep interval")))
+
+		_, err = load("-config", filepath.Join(dir, "missing.yaml"))
+		Expect(err).To(MatchError(ContainSubstring("reading error")))
+	})
+})
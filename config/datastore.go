@@ -0,0 +1,162 @@
+package config
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+)
+
+const redacted = "[REDACTED]"
+
+// DatastoreLocal is the datastore type that keeps everything in a file on this
+// host, for running the plugin without etcd on a single host.
+const DatastoreLocal api.DatastoreType = "local"
+
+// Datastore holds the settings for connecting to the Calico datastore.  Each
+// one that isn't set is taken from the environment variable that calicoctl and
+// calico/node read it from, e.g. ETCD_ENDPOINTS, or else its default.
+//
+// Passwords and tokens are only read from files, so that they don't appear in
+// the config file, command line or environment of the plugin.
+type Datastore struct {
+	// Type is etcdv2, kubernetes or local.
+	Type string `json:"type"`
+
+	EtcdEndpoints    string `json:"etcdEndpoints"`
+	EtcdUsername     string `json:"etcdUsername"`
+	EtcdPasswordFile string `json:"etcdPasswordFile"`
+	EtcdCACertFile   string `json:"etcdCACertFile"`
+	EtcdCertFile     string `json:"etcdCertFile"`
+	EtcdKeyFile      string `json:"etcdKeyFile"`
+
+	Kubeconfig      string `json:"kubeconfig"`
+	K8sAPIEndpoint  string `json:"k8sAPIEndpoint"`
+	K8sCAFile       string `json:"k8sCAFile"`
+	K8sCertFile     string `json:"k8sCertFile"`
+	K8sKeyFile      string `json:"k8sKeyFile"`
+	K8sAPITokenFile string `json:"k8sAPITokenFile"`
+
+	// The file the local datastore is kept in, and the CIDRs of its IP pools,
+	// which can't be created with calicoctl as there's no etcd.
+	LocalFile    string   `json:"localFile"`
+	LocalIPPools []string `json:"localIPPools"`
+}
+
+// DatastoreConfig returns the libcalico-go config for connecting to the
+// datastore, reading the secrets from their files.
+func (c *Config) DatastoreConfig() (*api.CalicoAPIConfig, error) {
+	config, err := datastoreClient.LoadClientConfig("")
+	if err != nil {
+		return nil, errors.Wrap(err, "Datastore config loading error")
+	}
+
+	d := c.Datastore
+	spec := &config.Spec
+	for _, setting := range []struct {
+		value string
+		field *string
+	}{
+		{d.EtcdEndpoints, &spec.EtcdEndpoints},
+		{d.EtcdUsername, &spec.EtcdUsername},
+		{d.EtcdCACertFile, &spec.EtcdCACertFile},
+		{d.EtcdCertFile, &spec.EtcdCertFile},
+		{d.EtcdKeyFile, &spec.EtcdKeyFile},
+		{d.Kubeconfig, &spec.Kubeconfig},
+		{d.K8sAPIEndpoint, &spec.K8sAPIEndpoint},
+		{d.K8sCAFile, &spec.K8sCAFile},
+		{d.K8sCertFile, &spec.K8sCertFile},
+		{d.K8sKeyFile, &spec.K8sKeyFile},
+	} {
+		if setting.value != "" {
+			*setting.field = setting.value
+		}
+	}
+	if d.Type != "" {
+		spec.DatastoreType = api.DatastoreType(d.Type)
+	}
+	if d.EtcdPasswordFile != "" {
+		if spec.EtcdPassword, err = readSecret(d.EtcdPasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	if d.K8sAPITokenFile != "" {
+		if spec.K8sAPIToken, err = readSecret(d.K8sAPITokenFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// CalicoClient creates the client for the datastore in datastoreConfig, which
+// is the local datastore if its type is local, and libcalico-go's otherwise.
+func (c *Config) CalicoClient(datastoreConfig *api.CalicoAPIConfig) (datastore.CalicoClient, error) {
+	if datastoreConfig.Spec.DatastoreType != DatastoreLocal {
+		client, err := datastoreClient.New(*datastoreConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "Datastore client creation error")
+		}
+		return client, nil
+	}
+
+	nodeName, _, err := c.NodeName()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := c.localIPPools()
+	if err != nil {
+		return nil, err
+	}
+	return datastore.OpenLocal(datastore.LocalConfig{
+		File:     c.Datastore.LocalFile,
+		NodeName: nodeName,
+		IPPools:  pools,
+	})
+}
+
+func (c *Config) localIPPools() ([]caliconet.IPNet, error) {
+	var pools []caliconet.IPNet
+	for _, cidr := range c.Datastore.LocalIPPools {
+		_, pool, err := caliconet.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("Invalid local IP pool %q, expected a CIDR", cidr)
+		}
+		pools = append(pools, *pool)
+	}
+	return pools, nil
+}
+
+// readSecret reads a password or token from a file, without the line ending
+// that editors and "echo" leave at the end.
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Datastore secret file %v reading error", path)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", errors.Errorf("Datastore secret file %v is empty", path)
+	}
+	return secret, nil
+}
+
+// RedactDatastore returns a copy of the datastore config without its secrets,
+// for logging.
+func RedactDatastore(config *api.CalicoAPIConfig) *api.CalicoAPIConfig {
+	if config == nil {
+		return nil
+	}
+	c := *config
+	if c.Spec.EtcdPassword != "" {
+		c.Spec.EtcdPassword = redacted
+	}
+	if c.Spec.K8sAPIToken != "" {
+		c.Spec.K8sAPIToken = redacted
+	}
+	return &c
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+)
+
+var _ = Describe("Datastore config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "datastore")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		os.Unsetenv("ETCD_ENDPOINTS")
+		os.Unsetenv("ETCD_USERNAME")
+	})
+
+	It("overrides the environment with the settings that are set", func() {
+		os.Setenv("ETCD_ENDPOINTS", "http://env:2379")
+		os.Setenv("ETCD_USERNAME", "env")
+		password := filepath.Join(dir, "password")
+		Expect(ioutil.WriteFile(password, []byte("hunter2\n"), 0600)).To(Succeed())
+
+		c := Defaults()
+		c.Datastore.EtcdEndpoints = "https://etcd1:2379,https://etcd2:2379"
+		c.Datastore.EtcdPasswordFile = password
+		c.Datastore.EtcdCACertFile = "/etc/calico/ca.pem"
+		config, err := c.DatastoreConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Spec.DatastoreType).To(Equal(api.EtcdV2))
+		Expect(config.Spec.EtcdEndpoints).To(Equal("https://etcd1:2379,https://etcd2:2379"))
+		Expect(config.Spec.EtcdUsername).To(Equal("env"))
+		Expect(config.Spec.EtcdPassword).To(Equal("hunter2"))
+		Expect(config.Spec.EtcdCACertFile).To(Equal("/etc/calico/ca.pem"))
+
+		redacted := RedactDatastore(config)
+		Expect(redacted.Spec.EtcdPassword).To(Equal("[REDACTED]"))
+		Expect(redacted.Spec.EtcdEndpoints).To(Equal(config.Spec.EtcdEndpoints))
+		Expect(config.Spec.EtcdPassword).To(Equal("hunter2"))
+	})
+
+	It("fails if a secret file can't be read or is empty", func() {
+		c := Defaults()
+		c.Datastore.K8sAPITokenFile = filepath.Join(dir, "missing")
+		_, err := c.DatastoreConfig()
+		Expect(err).To(MatchError(ContainSubstring("secret file")))
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "empty"), []byte("\n"), 0600)).To(Succeed())
+		c.Datastore.K8sAPITokenFile = filepath.Join(dir, "empty")
+		_, err = c.DatastoreConfig()
+		Expect(err).To(MatchError(ContainSubstring("is empty")))
+	})
+
+	It("rejects unknown datastore types", func() {
+		c := Defaults()
+		c.Datastore.Type = "consul"
+		Expect(c.Validate()).To(MatchError(ContainSubstring("Invalid datastore type")))
+		c.Datastore.Type = "kubernetes"
+		Expect(c.Validate()).To(Succeed())
+	})
+
+	It("opens the local datastore, with its configured IP pools", func() {
+		c := Defaults()
+		c.Hostname = "node1"
+		c.Datastore.Type = "local"
+		c.Datastore.LocalFile = filepath.Join(dir, "datastore.json")
+		c.Datastore.LocalIPPools = []string{"10.1.0.0/16"}
+		Expect(c.Validate()).To(Succeed())
+		config, err := c.DatastoreConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Spec.DatastoreType).To(Equal(DatastoreLocal))
+
+		client, err := c.CalicoClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		pools, err := client.IPPools().List(api.IPPoolMetadata{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(1))
+		Expect(pools.Items[0].Metadata.CIDR.String()).To(Equal("10.1.0.0/16"))
+
+		c.Datastore.LocalIPPools = []string{"10.1.0.0"}
+		Expect(c.Validate()).To(MatchError(ContainSubstring("Invalid local IP pool")))
+	})
+})
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	slowcallutils "github.com/projectcalico/libnetwork-plugin/utils/slowcall"
+)
+
+// Flags are the command line flags for the config file and every setting.
+type Flags struct {
+	flagSet *flag.FlagSet
+	file    string
+}
+
+// RegisterFlags adds the flags to the flag set.  Flags override the config
+// file and environment, but only when they are given.  Each flag's usage names
+// its environment variable.
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	f := &Flags{flagSet: flagSet}
+	flagSet.StringVar(&f.file, "config", os.Getenv(FileEnv), "Read settings from this YAML file")
+	bind(flagSet, Defaults())
+
+	settings := flag.NewFlagSet("", flag.ContinueOnError)
+	bind(settings, Defaults())
+	settings.VisitAll(func(fl *flag.Flag) {
+		flagSet.Lookup(fl.Name).Usage += fmt.Sprintf(" (%v)", EnvName(fl.Name))
+	})
+	return f
+}
+
+// Load loads the config from the file, the environment and the flags given,
+// once the flag set has been parsed, and validates it.
+func (f *Flags) Load() (*Config, error) {
+	c, err := Load(f.file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the given flags again, this time on the loaded config.
+	given := flag.NewFlagSet("", flag.ContinueOnError)
+	bind(given, c)
+	f.flagSet.Visit(func(fl *flag.Flag) {
+		if err == nil && given.Lookup(fl.Name) != nil {
+			err = given.Set(fl.Name, fl.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// bind adds a flag for each setting to the flag set, setting c.
+func bind(flagSet *flag.FlagSet, c *Config) {
+	flagSet.StringVar(&c.NetworkPluginName, "network-plugin-name", c.NetworkPluginName, "Name to register the network driver with Docker under")
+	flagSet.StringVar(&c.IPAMPluginName, "ipam-plugin-name", c.IPAMPluginName, "Name to register the IPAM driver with Docker under")
+	flagSet.StringVar(&c.SocketDir, "socket-dir", c.SocketDir, "Directory to create the plugin sockets in")
+	flagSet.StringVar(&c.SocketGroup, "socket-group", c.SocketGroup, "Group, by name or ID, that can use the plugin sockets")
+	flagSet.BoolVar(&c.EnableNetworkDriver, "enable-network-driver", c.EnableNetworkDriver, "Serve the network driver")
+	flagSet.BoolVar(&c.EnableIPAMDriver, "enable-ipam-driver", c.EnableIPAMDriver, "Serve the IPAM driver; if not, networks can use other IPAM drivers")
+	flagSet.BoolVar(&c.Managed, "managed", c.Managed, "Run as a Docker managed plugin, serving both drivers on the network driver's socket")
+	flagSet.StringVar(&c.TCP.NetworkAddr, "tcp-network-addr", c.TCP.NetworkAddr, "Serve the network driver on this TCP address, with mutual TLS, instead of a unix socket")
+	flagSet.StringVar(&c.TCP.IPAMAddr, "tcp-ipam-addr", c.TCP.IPAMAddr, "Serve the IPAM driver on this TCP address, with mutual TLS, instead of a unix socket")
+	flagSet.StringVar(&c.TCP.CertFile, "tcp-cert-file", c.TCP.CertFile, "TLS certificate of the drivers served on TCP")
+	flagSet.StringVar(&c.TCP.KeyFile, "tcp-key-file", c.TCP.KeyFile, "TLS key of the drivers served on TCP")
+	flagSet.StringVar(&c.TCP.ClientCAFile, "tcp-client-ca-file", c.TCP.ClientCAFile, "CA that Docker's TLS certificate must be signed by")
+	flagSet.StringVar(&c.TCP.SpecDir, "tcp-spec-dir", c.TCP.SpecDir, "Directory to write the files telling Docker the TCP addresses to")
+	flagSet.StringVar(&c.TCP.AdvertiseHost, "tcp-advertise-host", c.TCP.AdvertiseHost, "Host Docker should connect to, if not the one listened on")
+	flagSet.StringVar(&c.TCP.DockerCAFile, "tcp-docker-ca-file", c.TCP.DockerCAFile, "CA, as Docker sees it, that Docker verifies the drivers' certificate with")
+	flagSet.StringVar(&c.TCP.DockerCertFile, "tcp-docker-cert-file", c.TCP.DockerCertFile, "TLS certificate, as Docker sees it, that Docker identifies itself with")
+	flagSet.StringVar(&c.TCP.DockerKeyFile, "tcp-docker-key-file", c.TCP.DockerKeyFile, "TLS key, as Docker sees it, that Docker identifies itself with")
+	flagSet.StringVar(&c.Datastore.Type, "datastore-type", c.Datastore.Type, "Datastore type: etcdv2, kubernetes or local, instead of $DATASTORE_TYPE")
+	flagSet.StringVar(&c.Datastore.EtcdEndpoints, "etcd-endpoints", c.Datastore.EtcdEndpoints, "Comma separated etcd endpoints, instead of $ETCD_ENDPOINTS")
+	flagSet.StringVar(&c.Datastore.EtcdUsername, "etcd-username", c.Datastore.EtcdUsername, "etcd username, instead of $ETCD_USERNAME")
+	flagSet.StringVar(&c.Datastore.EtcdPasswordFile, "etcd-password-file", c.Datastore.EtcdPasswordFile, "File containing the etcd password, instead of $ETCD_PASSWORD")
+	flagSet.StringVar(&c.Datastore.EtcdCACertFile, "etcd-ca-cert-file", c.Datastore.EtcdCACertFile, "etcd CA certificate, instead of $ETCD_CA_CERT_FILE")
+	flagSet.StringVar(&c.Datastore.EtcdCertFile, "etcd-cert-file", c.Datastore.EtcdCertFile, "etcd client certificate, instead of $ETCD_CERT_FILE")
+	flagSet.StringVar(&c.Datastore.EtcdKeyFile, "etcd-key-file", c.Datastore.EtcdKeyFile, "etcd client key, instead of $ETCD_KEY_FILE")
+	flagSet.StringVar(&c.Datastore.Kubeconfig, "kubeconfig", c.Datastore.Kubeconfig, "Kubernetes config file, instead of $KUBECONFIG")
+	flagSet.StringVar(&c.Datastore.K8sAPIEndpoint, "k8s-api-endpoint", c.Datastore.K8sAPIEndpoint, "Kubernetes API endpoint, instead of $K8S_API_ENDPOINT")
+	flagSet.StringVar(&c.Datastore.K8sCAFile, "k8s-ca-file", c.Datastore.K8sCAFile, "Kubernetes CA certificate, instead of $K8S_CA_FILE")
+	flagSet.StringVar(&c.Datastore.K8sCertFile, "k8s-cert-file", c.Datastore.K8sCertFile, "Kubernetes client certificate, instead of $K8S_CERT_FILE")
+	flagSet.StringVar(&c.Datastore.K8sKeyFile, "k8s-key-file", c.Datastore.K8sKeyFile, "Kubernetes client key, instead of $K8S_KEY_FILE")
+	flagSet.StringVar(&c.Datastore.K8sAPITokenFile, "k8s-api-token-file", c.Datastore.K8sAPITokenFile, "File containing the Kubernetes API token, instead of $K8S_API_TOKEN")
+	flagSet.StringVar(&c.Datastore.LocalFile, "local-datastore-file", c.Datastore.LocalFile, "File the local datastore is kept in")
+	flagSet.Var(listValue{&c.Datastore.LocalIPPools}, "local-ip-pools", "Comma separated CIDRs of the local datastore's IP pools")
+	flagSet.StringVar(&c.Hostname, "hostname", c.Hostname, "Node to create endpoints on, instead of $NODENAME, the node name file, $HOSTNAME or the name of the host")
+	flagSet.StringVar(&c.NodenameFile, "nodename-file", c.NodenameFile, "File that calico/node writes the name of the node to")
+	flagSet.StringVar(&c.InterfacePrefix, "interface-prefix", c.InterfacePrefix, "Prefix of the name of the interface in each container, also set by CALICO_LIBNETWORK_IFPREFIX")
+	flagSet.StringVar(&c.DockerFallback, "docker-fallback", c.DockerFallback, "What to do when network names can't be looked up with the Docker API: error or network-id")
+	flagSet.StringVar(&c.MACAddress, "mac-address", c.MACAddress, "MAC address of the interface in each container")
+	flagSet.StringVar(&c.GatewayIPv4, "gateway-ipv4", c.GatewayIPv4, "Next hop of the default IPv4 route in each container")
+	flagSet.StringVar(&c.OrchestratorID, "orchestrator-id", c.OrchestratorID, "Orchestrator ID of the endpoints created; changing it orphans existing endpoints")
+	flagSet.StringVar(&c.WorkloadID, "workload-id", c.WorkloadID, "Workload ID of the endpoints created; changing it orphans existing endpoints")
+	flagSet.DurationVar((*time.Duration)(&c.RPCTimeout), "rpc-timeout", time.Duration(c.RPCTimeout), "Time allowed for the datastore and Docker operations of each request")
+	flagSet.StringVar(&c.ProfileIngress, "profile-ingress", c.ProfileIngress, "Traffic the profiles of new networks allow in: network (from the same network), all or none")
+	flagSet.StringVar(&c.ProfileEgress, "profile-egress", c.ProfileEgress, "Traffic the profiles of new networks allow out: all or none")
+	flagSet.DurationVar((*time.Duration)(&c.OrphanGracePeriod), "orphan-grace-period", time.Duration(c.OrphanGracePeriod), "Time after an endpoint is created before it can be removed as orphaned")
+	flagSet.DurationVar((*time.Duration)(&c.OrphanSweepDelay), "orphan-sweep-delay", time.Duration(c.OrphanSweepDelay), "Time after a container is removed before orphaned endpoints are swept")
+	flagSet.DurationVar((*time.Duration)(&c.OrphanSweepInterval), "orphan-sweep-interval", time.Duration(c.OrphanSweepInterval), "Time between sweeps for orphaned endpoints when no containers are removed")
+	flagSet.StringVar(&c.RetryQueue, "retry-queue", c.RetryQueue, "File that failed cleanup operations are saved to for retrying")
+	flagSet.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "Serve metrics and health checks on this address")
+	flagSet.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "Append a JSON record of every change made to the datastore to this file")
+
+	flagSet.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Log level: trace, debug, info, warning or error, also set to debug by CALICO_DEBUG")
+	flagSet.Var(levelsValue{&c.Log.Levels}, "log-levels", "Log levels for individual subsystems (plugin, network, ipam, netns, datastore), e.g. \"ipam=debug,netns=trace\"")
+	flagSet.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+	flagSet.StringVar(&c.Log.File, "log-file", c.Log.File, "Log to this file instead of stderr")
+	flagSet.IntVar(&c.Log.MaxSizeMB, "log-max-size", c.Log.MaxSizeMB, "Size in MB at which the log file is rotated, or 0 to never rotate it")
+	flagSet.IntVar(&c.Log.MaxBackups, "log-max-backups", c.Log.MaxBackups, "Number of rotated log files to keep")
+	flagSet.IntVar(&c.Log.MaxJSONLength, "log-max-json", c.Log.MaxJSONLength, "Length at which requests and responses logged at debug level are truncated, or 0 for no limit")
+	flagSet.Var(listValue{&c.Log.RedactKeys}, "log-redact-keys", "Comma separated keys, e.g. driver option names, whose values are never logged")
+
+	flagSet.StringVar(&c.Debug.Listen, "debug-listen", c.Debug.Listen, "Serve pprof, internal state, log levels and config reloads on this unix socket path or loopback TCP address, e.g. localhost:6060")
+	flagSet.StringVar(&c.Debug.TraceFile, "trace-file", c.Debug.TraceFile, "Append tracing spans for each request to this file, as OTLP/JSON")
+	flagSet.StringVar(&c.Debug.TraceEndpoint, "trace-endpoint", c.Debug.TraceEndpoint, "Send tracing spans for each request to this OTLP/HTTP collector, e.g. http://localhost:4318/v1/traces")
+	flagSet.DurationVar((*time.Duration)(&c.Debug.SlowCallThreshold), "slow-call-threshold", time.Duration(c.Debug.SlowCallThreshold), "Warn about driver calls that take longer than this, or 0 to never warn")
+	flagSet.Var(thresholdsValue{&c.Debug.SlowCallThresholds}, "slow-call-thresholds", "Thresholds for individual driver methods, e.g. \"network.Join=5s,ipam.RequestAddress=2s\"")
+}
+
+// Flag values for the settings that aren't a single string, number or
+// duration.  Each one's String can be Set again.
+
+type levelsValue struct {
+	levels *map[string]string
+}
+
+func (v levelsValue) String() string {
+	if v.levels == nil {
+		return ""
+	}
+	var pairs []string
+	for subsystem, level := range *v.levels {
+		pairs = append(pairs, subsystem+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v levelsValue) Set(s string) error {
+	levels, err := logutils.ParseSubsystemLevels(s)
+	if err != nil {
+		return err
+	}
+	*v.levels = levels
+	return nil
+}
+
+type thresholdsValue struct {
+	thresholds *map[string]Duration
+}
+
+func (v thresholdsValue) String() string {
+	if v.thresholds == nil {
+		return ""
+	}
+	var pairs []string
+	for method, threshold := range *v.thresholds {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", method, time.Duration(threshold)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v thresholdsValue) Set(s string) error {
+	thresholds, err := slowcallutils.ParseThresholds(s)
+	if err != nil {
+		return err
+	}
+	*v.thresholds = map[string]Duration{}
+	for method, threshold := range thresholds {
+		(*v.thresholds)[method] = Duration(threshold)
+	}
+	return nil
+}
+
+type listValue struct {
+	list *[]string
+}
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(s string) error {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*v.list = list
+	return nil
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Reload is the outcome of reloading the config: the settings that changed and
+// were applied, and those that changed but only take effect on a restart, by
+// config file key.
+type Reload struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// Reloader loads the config again, from the config file, environment and flags,
+// applying the changes to the settings that can be changed while the plugin is
+// running.
+type Reloader struct {
+	flags *Flags
+	apply func(*Config) error
+
+	mutex   sync.Mutex
+	current *Config
+}
+
+// NewReloader creates a reloader for the config loaded from flags.  apply is
+// called with the config to use after each reload that changes a setting that
+// can be changed while running, and must apply all of them or none.
+func NewReloader(flags *Flags, current *Config, apply func(*Config) error) *Reloader {
+	return &Reloader{flags: flags, apply: apply, current: current}
+}
+
+// Reload loads the config again.  The settings that can be changed while
+// running are applied, and changes to the others are logged and ignored.
+// Nothing is changed if the config is invalid or can't be applied.
+func (r *Reloader) Reload() (Reload, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	next, err := r.flags.Load()
+	if err != nil {
+		return Reload{}, errors.Wrap(err, "Config reloading error")
+	}
+	reloaded := *r.current
+	reloaded.reload(next)
+	result := Reload{
+		Applied:         changes(r.current, &reloaded),
+		RestartRequired: changes(&reloaded, next),
+	}
+
+	if len(result.Applied) > 0 {
+		if err := r.apply(&reloaded); err != nil {
+			return Reload{}, errors.Wrap(err, "Config reloading error")
+		}
+		r.current = &reloaded
+		log.Infof("Reloaded config, applying changes to %v", result.Applied)
+	} else {
+		log.Infoln("Reloaded config, with no changes to apply")
+	}
+	if len(result.RestartRequired) > 0 {
+		log.Warnf("Changes to %v only take effect when the plugin is restarted", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// reload copies the settings that can be changed while the plugin is running
+// from next.
+func (c *Config) reload(next *Config) {
+	c.DockerFallback = next.DockerFallback
+	c.MACAddress = next.MACAddress
+	c.GatewayIPv4 = next.GatewayIPv4
+	c.RPCTimeout = next.RPCTimeout
+	c.ProfileIngress = next.ProfileIngress
+	c.ProfileEgress = next.ProfileEgress
+	c.OrphanGracePeriod = next.OrphanGracePeriod
+	c.OrphanSweepDelay = next.OrphanSweepDelay
+	c.OrphanSweepInterval = next.OrphanSweepInterval
+
+	c.Log.Level = next.Log.Level
+	c.Log.Levels = next.Log.Levels
+	c.Log.MaxJSONLength = next.Log.MaxJSONLength
+	c.Log.RedactKeys = next.Log.RedactKeys
+
+	c.Debug.SlowCallThreshold = next.Debug.SlowCallThreshold
+	c.Debug.SlowCallThresholds = next.Debug.SlowCallThresholds
+}
+
+// changes returns the config file keys of the settings that differ, sorted.
+func changes(from, to *Config) []string {
+	fromValues, toValues := values(from), values(to)
+	changed := []string{}
+	for key, value := range toValues {
+		if fromValues[key] != value {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// values returns the JSON of each setting, by config file key, e.g.
+// "log.level".
+func values(c *Config) map[string]string {
+	// A Config always encodes, and each section encodes as an object.
+	data, _ := json.Marshal(c)
+	var top map[string]json.RawMessage
+	_ = json.Unmarshal(data, &top)
+
+	values := map[string]string{}
+	for key, value := range top {
+		var section map[string]json.RawMessage
+		if len(value) == 0 || value[0] != '{' || json.Unmarshal(value, &section) != nil {
+			values[key] = string(value)
+			continue
+		}
+		for subkey, subvalue := range section {
+			values[key+"."+subkey] = string(subvalue)
+		}
+	}
+	return values
+}
+
+// Handler reloads the config on POST, responding with the Reload as JSON.
+func (r *Reloader) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := r.Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reloader", func() {
+	var (
+		dir, file string
+		applied   []*Config
+		applyErr  error
+		reloader  *Reloader
+	)
+
+	write := func(yaml string) {
+		Expect(ioutil.WriteFile(file, []byte(yaml), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "libnetwork-plugin.yaml")
+		write("socketDir: /run/docker/plugins\nlog:\n  level: info\n")
+
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(flagSet)
+		Expect(flagSet.Parse([]string{"-config", file, "-mac-address", "EE:EE:EE:EE:EE:01"})).To(Succeed())
+		current, err := flags.Load()
+		Expect(err).NotTo(HaveOccurred())
+
+		applied, applyErr = nil, nil
+		reloader = NewReloader(flags, current, func(c *Config) error {
+			if applyErr != nil {
+				return applyErr
+			}
+			applied = append(applied, c)
+			return nil
+		})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("applies the settings that can be changed while running, keeping the others", func() {
+		write("socketDir: /run/calico\nrpcTimeout: 5s\nmacAddress: EE:EE:EE:EE:EE:02\nlog:\n  level: debug\n  format: json\n")
+
+		result, err := reloader.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(Reload{
+			Applied:         []string{"log.level", "rpcTimeout"},
+			RestartRequired: []string{"log.format", "socketDir"},
+		}))
+		Expect(applied).To(HaveLen(1))
+		Expect(applied[0].Log.Level).To(Equal("debug"))
+		Expect(applied[0].RPCTimeout).To(Equal(Duration(5 * time.Second)))
+		Expect(applied[0].SocketDir).To(Equal("/run/docker/plugins"))
+		Expect(applied[0].Log.Format).To(Equal("text"))
+		Expect(applied[0].MACAddress).To(Equal("EE:EE:EE:EE:EE:01"), "flags still override the file")
+
+		result, err = reloader.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Applied).To(BeEmpty())
+		Expect(applied).To(HaveLen(1))
+	})
+
+	It("applies the policy defaults and orphaned endpoint sweep timings", func() {
+		write("profileIngress: all\nprofileEgress: none\norphanGracePeriod: 30s\norphanSweepDelay: 1s\norphanSweepInterval: 1m\n")
+
+		result, err := reloader.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Applied).To(Equal([]string{"orphanGracePeriod", "orphanSweepDelay", "orphanSweepInterval", "profileEgress", "profileIngress"}))
+		Expect(result.RestartRequired).To(BeEmpty())
+		Expect(applied).To(HaveLen(1))
+
+		d := applied[0].Driver("node1")
+		Expect(d.ProfileIngress).To(Equal("all"))
+		Expect(d.ProfileEgress).To(Equal("none"))
+		Expect(d.OrphanGracePeriod).To(Equal(30 * time.Second))
+		Expect(d.OrphanSweepDelay).To(Equal(time.Second))
+		Expect(d.OrphanSweepInterval).To(Equal(time.Minute))
+	})
+
+	It("changes nothing if the config is invalid or can't be applied", func() {
+		write("rpcTimeout: 0s\n")
+		_, err := reloader.Reload()
+		Expect(err).To(MatchError(ContainSubstring("Config reloading error")))
+
+		write("log:\n  level: debug\n")
+		applyErr = errors.New("bad level")
+		_, err = reloader.Reload()
+		Expect(err).To(MatchError(ContainSubstring("bad level")))
+		Expect(applied).To(BeEmpty())
+
+		applyErr = nil
+		result, err := reloader.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Applied).To(Equal([]string{"log.level"}))
+	})
+
+	It("reloads on POST", func() {
+		write("log:\n  level: debug\n")
+
+		w := httptest.NewRecorder()
+		reloader.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/reload", nil))
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(applied).To(BeEmpty())
+
+		w = httptest.NewRecorder()
+		reloader.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		var result Reload
+		Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+		Expect(result.Applied).To(Equal([]string{"log.level"}))
+
+		write("rpcTimeout: 0s\n")
+		w = httptest.NewRecorder()
+		reloader.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
+)
+
+var log = logutils.Datastore
+
+// Client wraps the libcalico-go client so that every datastore operation made
+// by the drivers is bounded by the deadline of the RPC that made it.  Errors
+// from libcalico-go are returned unchanged; a timeout.Error naming the
+// operation is returned if the deadline passes first, in which case any other
+// results are discarded.
+//
+// Every operation that modifies the datastore is recorded in the audit log,
+// with its real outcome even if that is only known after the deadline.
+type Client struct {
+	client CalicoClient
+	audit  *audit.Log
+}
+
+// CalicoClient is the part of the libcalico-go client used by Client.  It is
+// satisfied by *client.Client, and lets the datastore be faked in tests.
+type CalicoClient interface {
+	Nodes() datastoreClient.NodeInterface
+	Profiles() datastoreClient.ProfileInterface
+	WorkloadEndpoints() datastoreClient.WorkloadEndpointInterface
+	IPPools() datastoreClient.IPPoolInterface
+	IPAM() datastoreClient.IPAMInterface
+}
+
+// NewClient wraps the libcalico-go client.  The audit log may be nil, in which
+// case nothing is audited.
+func NewClient(client CalicoClient, auditLog *audit.Log) *Client {
+	return &Client{client: client, audit: auditLog}
+}
+
+// run performs a datastore operation under the context's deadline, logging it
+// with the context's correlation ID and tracing it as a step of the request.
+//
+// libcalico-go takes neither a context nor a per-request timeout, so an
+// operation still running at the deadline can't be cancelled.  late, if given,
+// is called with its result once it completes, see timeout.RunLate.
+func run(ctx context.Context, step string, f func() error, late func(err error)) error {
+	log := log.WithContext(ctx)
+	_, span := traceutils.StartSpan(ctx, step, traceutils.KindClient)
+	log.Tracef("Starting %v", step)
+	err := timeoututils.RunLate(ctx, step, f, late)
+	span.Finish(err)
+	if err != nil {
+		log.Debugf("Failed %v: %v", step, err)
+		return err
+	}
+	log.Tracef("Finished %v", step)
+	return nil
+}
+
+// change runs a datastore change like run, passing its outcome to record for
+// the audit log.  If the deadline passes before the change completes, the
+// outcome is recorded once it does, and a late success is reversed with undo,
+// if given, since the driver will already have reported the change as failed.
+// Otherwise the change would be left behind, e.g. an address assigned to no
+// container, with nothing to clean it up.
+func change(ctx context.Context, step string, f func() error, record func(err error), undo func() error) error {
+	err := run(ctx, step, f, func(err error) {
+		record(err)
+		if err != nil || undo == nil {
+			return
+		}
+		log := log.WithContext(ctx)
+		log.Warnf("Undoing %v, which completed after its deadline", step)
+		if err := undo(); err != nil {
+			log.Errorln(errors.Wrapf(err, "Undoing %v error", step))
+		}
+	})
+
+	// Otherwise the outcome has been, or will be, passed to the function
+	// above.
+	if !timeoututils.IsTimeout(err) && err != context.Canceled {
+		record(err)
+	}
+	return err
+}
+
+func (c *Client) GetNode(ctx context.Context, name string) (*api.Node, error) {
+	var node *api.Node
+	if err := run(ctx, "datastore node fetching", func() (err error) {
+		node, err = c.client.Nodes().Get(api.NodeMetadata{Name: name})
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (c *Client) CreateProfile(ctx context.Context, profile *api.Profile) error {
+	return change(ctx, "datastore profile creation", func() error {
+		_, err := c.client.Profiles().Create(profile)
+		return err
+	}, func(err error) {
+		// The profile is created for each endpoint, so it normally exists
+		// already, and nothing has been changed.
+		if _, ok := err.(libcalicoErrors.ErrorResourceAlreadyExists); ok {
+			return
+		}
+		c.audit.Record(ctx, "CreateProfile", profileKey(profile.Metadata), err)
+	}, nil)
+}
+
+func (c *Client) GetWorkloadEndpoint(ctx context.Context, metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpoint, error) {
+	var endpoint *api.WorkloadEndpoint
+	if err := run(ctx, "datastore workload endpoint fetching", func() (err error) {
+		endpoint, err = c.client.WorkloadEndpoints().Get(metadata)
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (c *Client) ListWorkloadEndpoints(ctx context.Context, metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpointList, error) {
+	var endpoints *api.WorkloadEndpointList
+	if err := run(ctx, "datastore workload endpoints listing", func() (err error) {
+		endpoints, err = c.client.WorkloadEndpoints().List(metadata)
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (c *Client) CreateWorkloadEndpoint(ctx context.Context, endpoint *api.WorkloadEndpoint) error {
+	key := workloadEndpointKey(endpoint.Metadata)
+	return change(ctx, "datastore workload endpoint creation", func() error {
+		_, err := c.client.WorkloadEndpoints().Create(endpoint)
+		return err
+	}, func(err error) {
+		c.audit.Record(ctx, "CreateWorkloadEndpoint", key, err)
+	}, func() error {
+		err := c.client.WorkloadEndpoints().Delete(endpoint.Metadata)
+		c.audit.Record(ctx, "DeleteWorkloadEndpoint", key, err)
+		return err
+	})
+}
+
+func (c *Client) UpdateWorkloadEndpoint(ctx context.Context, endpoint *api.WorkloadEndpoint) error {
+	return change(ctx, "datastore workload endpoint update", func() error {
+		_, err := c.client.WorkloadEndpoints().Update(endpoint)
+		return err
+	}, func(err error) {
+		c.audit.Record(ctx, "UpdateWorkloadEndpoint", workloadEndpointKey(endpoint.Metadata), err)
+	}, nil)
+}
+
+func (c *Client) DeleteWorkloadEndpoint(ctx context.Context, metadata api.WorkloadEndpointMetadata) error {
+	return change(ctx, "datastore workload endpoint removal", func() error {
+		return c.client.WorkloadEndpoints().Delete(metadata)
+	}, func(err error) {
+		c.audit.Record(ctx, "DeleteWorkloadEndpoint", workloadEndpointKey(metadata), err)
+	}, nil)
+}
+
+func (c *Client) GetIPPool(ctx context.Context, metadata api.IPPoolMetadata) (*api.IPPool, error) {
+	var pool *api.IPPool
+	if err := run(ctx, "datastore IP pool fetching", func() (err error) {
+		pool, err = c.client.IPPools().Get(metadata)
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (c *Client) ListIPPools(ctx context.Context, metadata api.IPPoolMetadata) (*api.IPPoolList, error) {
+	var pools *api.IPPoolList
+	if err := run(ctx, "datastore IP pools listing", func() (err error) {
+		pools, err = c.client.IPPools().List(metadata)
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func (c *Client) AutoAssign(ctx context.Context, args datastoreClient.AutoAssignArgs) ([]caliconet.IP, []caliconet.IP, error) {
+	var ipsV4, ipsV6 []caliconet.IP
+	if err := change(ctx, "datastore IP auto assignment", func() (err error) {
+		ipsV4, ipsV6, err = c.client.IPAM().AutoAssign(args)
+		return
+	}, func(err error) {
+		if err != nil {
+			c.audit.Record(ctx, "AutoAssign", ipKey(nil), err)
+			return
+		}
+		for _, ip := range append(ipsV4, ipsV6...) {
+			c.audit.Record(ctx, "AutoAssign", ipKey(&ip), nil)
+		}
+	}, func() error {
+		return c.releaseIPs(ctx, append(ipsV4, ipsV6...))
+	}); err != nil {
+		return nil, nil, err
+	}
+	return ipsV4, ipsV6, nil
+}
+
+func (c *Client) AssignIP(ctx context.Context, args datastoreClient.AssignIPArgs) error {
+	return change(ctx, "datastore IP assignment", func() error {
+		return c.client.IPAM().AssignIP(args)
+	}, func(err error) {
+		c.audit.Record(ctx, "AssignIP", ipKey(&args.IP), err)
+	}, func() error {
+		return c.releaseIPs(ctx, []caliconet.IP{args.IP})
+	})
+}
+
+func (c *Client) ReleaseIPs(ctx context.Context, ips []caliconet.IP) ([]caliconet.IP, error) {
+	var unallocated []caliconet.IP
+	if err := change(ctx, "datastore IP release", func() (err error) {
+		unallocated, err = c.client.IPAM().ReleaseIPs(ips)
+		return
+	}, func(err error) {
+		c.recordRelease(ctx, ips, err)
+	}, nil); err != nil {
+		return nil, err
+	}
+	return unallocated, nil
+}
+
+// releaseIPs releases addresses without a deadline, to undo their assignment.
+func (c *Client) releaseIPs(ctx context.Context, ips []caliconet.IP) error {
+	_, err := c.client.IPAM().ReleaseIPs(ips)
+	c.recordRelease(ctx, ips, err)
+	return err
+}
+
+func (c *Client) recordRelease(ctx context.Context, ips []caliconet.IP, err error) {
+	for _, ip := range ips {
+		c.audit.Record(ctx, "ReleaseIPs", ipKey(&ip), err)
+	}
+}
+
+func (c *Client) GetAssignmentAttributes(ctx context.Context, ip caliconet.IP) (map[string]string, error) {
+	var attributes map[string]string
+	if err := run(ctx, "datastore IP assignment attributes fetching", func() (err error) {
+		attributes, err = c.client.IPAM().GetAssignmentAttributes(ip)
+		return
+	}, nil); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// Keys identifying the objects in audit records.
+
+func profileKey(metadata api.ProfileMetadata) string {
+	return "profile/" + metadata.Name
+}
+
+func workloadEndpointKey(metadata api.WorkloadEndpointMetadata) string {
+	return fmt.Sprintf("workloadEndpoint/%v/%v/%v/%v", metadata.Node, metadata.Orchestrator, metadata.Workload, metadata.Name)
+}
+
+// ipKey returns the key for an address, or for an automatically assigned
+// address that couldn't be assigned if ip is nil.
+func ipKey(ip *caliconet.IP) string {
+	if ip == nil {
+		return "ip/auto"
+	}
+	return "ip/" + ip.String()
+}
@@ -0,0 +1,656 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// LocalConfig holds the settings of a local datastore.
+type LocalConfig struct {
+	// File keeps the profiles, workload endpoints and address assignments.
+	File string
+
+	// NodeName is the only node, which is treated as registered.
+	NodeName string
+
+	// IPPools are the pools that addresses are assigned from.
+	IPPools []caliconet.IPNet
+}
+
+// Local is a datastore kept in a file on this host, so that the plugin can be
+// run on a single host without etcd, e.g. on a laptop or in CI.  It implements
+// CalicoClient, so the drivers use it as they would libcalico-go.
+//
+// Profiles, workload endpoints and address assignments are kept in the file,
+// which is locked for each operation so that the "check" and "diags" commands
+// can read it while the plugin is running.  The node and IP pools are
+// configured rather than stored, so they can't be changed through the client.
+//
+// Felix can't read it, so nothing programs the routes to the containers: they
+// get addresses but no connectivity.
+type Local struct {
+	path  string
+	node  api.Node
+	pools []api.IPPool
+}
+
+// localState is the content of the file.
+type localState struct {
+	Profiles          map[string]api.Profile          `json:"profiles"`
+	WorkloadEndpoints map[string]api.WorkloadEndpoint `json:"workloadEndpoints"`
+	Assignments       map[string]localAssignment      `json:"assignments"`
+}
+
+// localAssignment is an assigned address.
+type localAssignment struct {
+	IP       caliconet.IP      `json:"ip"`
+	HandleID string            `json:"handleID,omitempty"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Node     string            `json:"node"`
+}
+
+// OpenLocal opens the local datastore, creating the directory of its file if
+// needed.  The file itself is created by the first change.
+func OpenLocal(config LocalConfig) (*Local, error) {
+	if config.NodeName == "" {
+		return nil, errors.New("Local datastore node name isn't set")
+	}
+	if err := os.MkdirAll(filepath.Dir(config.File), 0755); err != nil {
+		return nil, errors.Wrapf(err, "Local datastore directory %v creation error", filepath.Dir(config.File))
+	}
+
+	l := &Local{path: config.File, node: *api.NewNode()}
+	l.node.Metadata.Name = config.NodeName
+	for _, cidr := range config.IPPools {
+		pool := api.NewIPPool()
+		pool.Metadata.CIDR = cidr
+		l.pools = append(l.pools, *pool)
+	}
+
+	// Fail now, rather than on the first request, if the file can't be read.
+	if err := l.view(func(*localState) error { return nil }); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Local) Nodes() datastoreClient.NodeInterface {
+	return localNodes{l}
+}
+
+func (l *Local) Profiles() datastoreClient.ProfileInterface {
+	return localProfiles{l}
+}
+
+func (l *Local) WorkloadEndpoints() datastoreClient.WorkloadEndpointInterface {
+	return localWorkloadEndpoints{l}
+}
+
+func (l *Local) IPPools() datastoreClient.IPPoolInterface {
+	return localIPPools{l}
+}
+
+func (l *Local) IPAM() datastoreClient.IPAMInterface {
+	return localIPAM{l}
+}
+
+// view calls f with the current content of the file, under a shared lock.
+func (l *Local) view(f func(state *localState) error) error {
+	unlock, err := l.lock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := l.load()
+	if err != nil {
+		return err
+	}
+	return f(state)
+}
+
+// update calls f with the current content of the file, under an exclusive
+// lock, and saves the changes it makes unless it fails.
+func (l *Local) update(f func(state *localState) error) error {
+	unlock, err := l.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := l.load()
+	if err != nil {
+		return err
+	}
+	if err := f(state); err != nil {
+		return err
+	}
+	return l.save(state)
+}
+
+// lock takes a lock on the file, returning the function that releases it.  A
+// separate lock file is used, since saving replaces the file.
+func (l *Local) lock(how int) (func(), error) {
+	lockPath := l.path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Local datastore lock %v opening error", lockPath)
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "Local datastore lock %v locking error", lockPath)
+	}
+	return func() { lock.Close() }, nil
+}
+
+func (l *Local) load() (*localState, error) {
+	state := &localState{}
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Local datastore %v reading error", l.path)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, errors.Wrapf(err, "Local datastore %v parsing error", l.path)
+		}
+	}
+	if state.Profiles == nil {
+		state.Profiles = map[string]api.Profile{}
+	}
+	if state.WorkloadEndpoints == nil {
+		state.WorkloadEndpoints = map[string]api.WorkloadEndpoint{}
+	}
+	if state.Assignments == nil {
+		state.Assignments = map[string]localAssignment{}
+	}
+	return state, nil
+}
+
+// save replaces the file, so that it's never left half written.
+func (l *Local) save(state *localState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Local datastore encoding error")
+	}
+	tempPath := l.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return errors.Wrapf(err, "Local datastore %v writing error", tempPath)
+	}
+	if err := os.Rename(tempPath, l.path); err != nil {
+		return errors.Wrapf(err, "Local datastore %v replacing error", l.path)
+	}
+	return nil
+}
+
+// pool returns the enabled pool containing ip, if there is one.
+func (l *Local) pool(ip net.IP) *api.IPPool {
+	for i, pool := range l.pools {
+		if pool.Metadata.CIDR.Contains(ip) && !pool.Spec.Disabled {
+			return &l.pools[i]
+		}
+	}
+	return nil
+}
+
+// selected reports whether pool is one of the pools given, or true if none
+// are.
+func selected(pool api.IPPool, only []caliconet.IPNet) bool {
+	if len(only) == 0 {
+		return true
+	}
+	for _, cidr := range only {
+		if cidr.String() == pool.Metadata.CIDR.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Configured objects, which can only be read.
+
+type localNodes struct {
+	*Local
+}
+
+func (n localNodes) List(metadata api.NodeMetadata) (*api.NodeList, error) {
+	list := api.NewNodeList()
+	if metadata.Name == "" || metadata.Name == n.node.Metadata.Name {
+		list.Items = append(list.Items, n.node)
+	}
+	return list, nil
+}
+
+func (n localNodes) Get(metadata api.NodeMetadata) (*api.Node, error) {
+	if metadata.Name != n.node.Metadata.Name {
+		return nil, libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+	}
+	node := n.node
+	return &node, nil
+}
+
+func (n localNodes) Create(node *api.Node) (*api.Node, error) {
+	return nil, notSupported("create", node.Metadata)
+}
+
+func (n localNodes) Update(node *api.Node) (*api.Node, error) {
+	return nil, notSupported("update", node.Metadata)
+}
+
+func (n localNodes) Apply(node *api.Node) (*api.Node, error) {
+	return nil, notSupported("apply", node.Metadata)
+}
+
+func (n localNodes) Delete(metadata api.NodeMetadata) error {
+	return notSupported("delete", metadata)
+}
+
+type localIPPools struct {
+	*Local
+}
+
+func (p localIPPools) List(metadata api.IPPoolMetadata) (*api.IPPoolList, error) {
+	list := api.NewIPPoolList()
+	for _, pool := range p.pools {
+		if metadata.CIDR.IP == nil || metadata.CIDR.String() == pool.Metadata.CIDR.String() {
+			list.Items = append(list.Items, pool)
+		}
+	}
+	return list, nil
+}
+
+func (p localIPPools) Get(metadata api.IPPoolMetadata) (*api.IPPool, error) {
+	for _, pool := range p.pools {
+		if metadata.CIDR.String() == pool.Metadata.CIDR.String() {
+			return &pool, nil
+		}
+	}
+	return nil, libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+}
+
+func (p localIPPools) Create(pool *api.IPPool) (*api.IPPool, error) {
+	return nil, notSupported("create", pool.Metadata)
+}
+
+func (p localIPPools) Update(pool *api.IPPool) (*api.IPPool, error) {
+	return nil, notSupported("update", pool.Metadata)
+}
+
+func (p localIPPools) Apply(pool *api.IPPool) (*api.IPPool, error) {
+	return nil, notSupported("apply", pool.Metadata)
+}
+
+func (p localIPPools) Delete(metadata api.IPPoolMetadata) error {
+	return notSupported("delete", metadata)
+}
+
+// notSupported is returned for changes to the node and IP pools, which are
+// configured rather than stored.
+func notSupported(operation string, identifier interface{}) error {
+	return libcalicoErrors.ErrorOperationNotSupported{Operation: operation, Identifier: identifier}
+}
+
+// Stored objects.
+
+type localProfiles struct {
+	*Local
+}
+
+func (p localProfiles) List(metadata api.ProfileMetadata) (*api.ProfileList, error) {
+	list := api.NewProfileList()
+	err := p.view(func(state *localState) error {
+		for _, key := range sortedKeys(state.Profiles) {
+			if profile := state.Profiles[key]; metadata.Name == "" || metadata.Name == profile.Metadata.Name {
+				list.Items = append(list.Items, profile)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (p localProfiles) Get(metadata api.ProfileMetadata) (*api.Profile, error) {
+	var profile api.Profile
+	err := p.view(func(state *localState) error {
+		var ok bool
+		if profile, ok = state.Profiles[profileKey(metadata)]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (p localProfiles) Create(profile *api.Profile) (*api.Profile, error) {
+	err := p.update(func(state *localState) error {
+		key := profileKey(profile.Metadata)
+		if _, ok := state.Profiles[key]; ok {
+			return libcalicoErrors.ErrorResourceAlreadyExists{Identifier: profile.Metadata}
+		}
+		state.Profiles[key] = *profile
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (p localProfiles) Update(profile *api.Profile) (*api.Profile, error) {
+	err := p.update(func(state *localState) error {
+		key := profileKey(profile.Metadata)
+		if _, ok := state.Profiles[key]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: profile.Metadata}
+		}
+		state.Profiles[key] = *profile
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (p localProfiles) Apply(profile *api.Profile) (*api.Profile, error) {
+	err := p.update(func(state *localState) error {
+		state.Profiles[profileKey(profile.Metadata)] = *profile
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (p localProfiles) Delete(metadata api.ProfileMetadata) error {
+	return p.update(func(state *localState) error {
+		key := profileKey(metadata)
+		if _, ok := state.Profiles[key]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+		}
+		delete(state.Profiles, key)
+		return nil
+	})
+}
+
+type localWorkloadEndpoints struct {
+	*Local
+}
+
+func (w localWorkloadEndpoints) List(metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpointList, error) {
+	list := api.NewWorkloadEndpointList()
+	err := w.view(func(state *localState) error {
+		for _, key := range sortedKeys(state.WorkloadEndpoints) {
+			endpoint := state.WorkloadEndpoints[key]
+			m := endpoint.Metadata
+			if (metadata.Node == "" || metadata.Node == m.Node) &&
+				(metadata.Orchestrator == "" || metadata.Orchestrator == m.Orchestrator) &&
+				(metadata.Workload == "" || metadata.Workload == m.Workload) &&
+				(metadata.Name == "" || metadata.Name == m.Name) {
+				list.Items = append(list.Items, endpoint)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (w localWorkloadEndpoints) Get(metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpoint, error) {
+	var endpoint api.WorkloadEndpoint
+	err := w.view(func(state *localState) error {
+		var ok bool
+		if endpoint, ok = state.WorkloadEndpoints[workloadEndpointKey(metadata)]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+func (w localWorkloadEndpoints) Create(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	err := w.update(func(state *localState) error {
+		key := workloadEndpointKey(endpoint.Metadata)
+		if _, ok := state.WorkloadEndpoints[key]; ok {
+			return libcalicoErrors.ErrorResourceAlreadyExists{Identifier: endpoint.Metadata}
+		}
+		state.WorkloadEndpoints[key] = *endpoint
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (w localWorkloadEndpoints) Update(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	err := w.update(func(state *localState) error {
+		key := workloadEndpointKey(endpoint.Metadata)
+		if _, ok := state.WorkloadEndpoints[key]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: endpoint.Metadata}
+		}
+		state.WorkloadEndpoints[key] = *endpoint
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (w localWorkloadEndpoints) Apply(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	err := w.update(func(state *localState) error {
+		state.WorkloadEndpoints[workloadEndpointKey(endpoint.Metadata)] = *endpoint
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (w localWorkloadEndpoints) Delete(metadata api.WorkloadEndpointMetadata) error {
+	return w.update(func(state *localState) error {
+		key := workloadEndpointKey(metadata)
+		if _, ok := state.WorkloadEndpoints[key]; !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+		}
+		delete(state.WorkloadEndpoints, key)
+		return nil
+	})
+}
+
+// localIPAM assigns addresses one at a time from the configured pools, rather
+// than in blocks affine to hosts as libcalico-go does, since there's only one
+// host.
+type localIPAM struct {
+	*Local
+}
+
+func (i localIPAM) AssignIP(args datastoreClient.AssignIPArgs) error {
+	return i.update(func(state *localState) error {
+		if i.pool(args.IP.IP) == nil {
+			return errors.Errorf("Address %v isn't in any enabled IP pool", args.IP)
+		}
+		if _, ok := state.Assignments[args.IP.String()]; ok {
+			return errors.Errorf("Address %v is already assigned", args.IP)
+		}
+		state.Assignments[args.IP.String()] = newAssignment(args.IP, args.HandleID, args.Attrs, i.node.Metadata.Name)
+		return nil
+	})
+}
+
+func (i localIPAM) AutoAssign(args datastoreClient.AutoAssignArgs) ([]caliconet.IP, []caliconet.IP, error) {
+	var ipsV4, ipsV6 []caliconet.IP
+	err := i.update(func(state *localState) (err error) {
+		if ipsV4, err = i.assign(state, 4, args.Num4, args.IPv4Pools, args); err != nil {
+			return err
+		}
+		ipsV6, err = i.assign(state, 6, args.Num6, args.IPv6Pools, args)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ipsV4, ipsV6, nil
+}
+
+// assign assigns num free addresses of the given version, from the pools given
+// or else from any pool.
+func (i localIPAM) assign(state *localState, version, num int, only []caliconet.IPNet, args datastoreClient.AutoAssignArgs) ([]caliconet.IP, error) {
+	var ips []caliconet.IP
+	for _, pool := range i.pools {
+		cidr := pool.Metadata.CIDR
+		if len(ips) == num {
+			break
+		}
+		if pool.Spec.Disabled || cidr.Version() != version || !selected(pool, only) {
+			continue
+		}
+		for ip := cidr.IP.Mask(cidr.Mask); cidr.Contains(ip) && len(ips) < num; ip = nextIP(ip) {
+			if _, ok := state.Assignments[ip.String()]; ok {
+				continue
+			}
+			assigned := caliconet.IP{IP: ip}
+			state.Assignments[ip.String()] = newAssignment(assigned, args.HandleID, args.Attrs, i.node.Metadata.Name)
+			ips = append(ips, assigned)
+		}
+	}
+	if len(ips) < num {
+		return nil, errors.Errorf("Only %v of the %v IPv%v addresses requested are free in the IP pools", len(ips), num, version)
+	}
+	return ips, nil
+}
+
+func (i localIPAM) ReleaseIPs(ips []caliconet.IP) ([]caliconet.IP, error) {
+	var unallocated []caliconet.IP
+	err := i.update(func(state *localState) error {
+		unallocated = nil
+		for _, ip := range ips {
+			if _, ok := state.Assignments[ip.String()]; !ok {
+				unallocated = append(unallocated, ip)
+			}
+			delete(state.Assignments, ip.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unallocated, nil
+}
+
+func (i localIPAM) GetAssignmentAttributes(addr caliconet.IP) (map[string]string, error) {
+	var attrs map[string]string
+	err := i.view(func(state *localState) error {
+		assignment, ok := state.Assignments[addr.String()]
+		if !ok {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: addr.String()}
+		}
+		attrs = assignment.Attrs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (i localIPAM) IPsByHandle(handleID string) ([]caliconet.IP, error) {
+	var ips []caliconet.IP
+	err := i.view(func(state *localState) error {
+		for _, key := range sortedKeys(state.Assignments) {
+			if assignment := state.Assignments[key]; assignment.HandleID == handleID {
+				ips = append(ips, assignment.IP)
+			}
+		}
+		if len(ips) == 0 {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: handleID}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+func (i localIPAM) ReleaseByHandle(handleID string) error {
+	return i.update(func(state *localState) error {
+		released := false
+		for key, assignment := range state.Assignments {
+			if assignment.HandleID == handleID {
+				delete(state.Assignments, key)
+				released = true
+			}
+		}
+		if !released {
+			return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: handleID}
+		}
+		return nil
+	})
+}
+
+// Blocks aren't used, so there are no affinities to claim or release.
+
+func (i localIPAM) ClaimAffinity(cidr caliconet.IPNet, host string) ([]caliconet.IPNet, []caliconet.IPNet, error) {
+	return nil, nil, nil
+}
+
+func (i localIPAM) ReleaseAffinity(cidr caliconet.IPNet, host string) error {
+	return nil
+}
+
+func newAssignment(ip caliconet.IP, handleID *string, attrs map[string]string, node string) localAssignment {
+	assignment := localAssignment{IP: ip, Attrs: attrs, Node: node}
+	if handleID != nil {
+		assignment.HandleID = *handleID
+	}
+	return assignment
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// sortedKeys returns the keys of a map of stored objects in order, so that
+// they're always listed in the same order.
+func sortedKeys(objects interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(objects).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+)
+
+var _ = Describe("Local datastore", func() {
+	var dir string
+	var config LocalConfig
+	var store *Client
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "datastore")
+		Expect(err).NotTo(HaveOccurred())
+		_, pool, err := caliconet.ParseCIDR("10.0.0.0/30")
+		Expect(err).NotTo(HaveOccurred())
+		config = LocalConfig{
+			File:     filepath.Join(dir, "calico", "datastore.json"),
+			NodeName: "node1",
+			IPPools:  []caliconet.IPNet{*pool},
+		}
+		local, err := OpenLocal(config)
+		Expect(err).NotTo(HaveOccurred())
+		store = NewClient(local, nil)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	endpoint := func(name string) *api.WorkloadEndpoint {
+		endpoint := api.NewWorkloadEndpoint()
+		endpoint.Metadata.Node = "node1"
+		endpoint.Metadata.Orchestrator = "libnetwork"
+		endpoint.Metadata.Workload = "libnetwork"
+		endpoint.Metadata.Name = name
+		return endpoint
+	}
+
+	It("treats the configured node and IP pools as registered", func() {
+		node, err := store.GetNode(ctx, "node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(node.Metadata.Name).To(Equal("node1"))
+		_, err = store.GetNode(ctx, "node2")
+		Expect(err).To(BeAssignableToTypeOf(libcalicoErrors.ErrorResourceDoesNotExist{}))
+
+		pools, err := store.ListIPPools(ctx, api.IPPoolMetadata{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(1))
+		Expect(pools.Items[0].Metadata.CIDR.String()).To(Equal("10.0.0.0/30"))
+	})
+
+	It("keeps workload endpoints in the file", func() {
+		Expect(store.CreateWorkloadEndpoint(ctx, endpoint("ep1"))).To(Succeed())
+		Expect(store.CreateWorkloadEndpoint(ctx, endpoint("ep1"))).To(BeAssignableToTypeOf(libcalicoErrors.ErrorResourceAlreadyExists{}))
+		Expect(store.CreateWorkloadEndpoint(ctx, endpoint("ep2"))).To(Succeed())
+
+		// A second instance, e.g. "libnetwork-plugin check", sees the same
+		// endpoints.
+		local, err := OpenLocal(config)
+		Expect(err).NotTo(HaveOccurred())
+		endpoints, err := NewClient(local, nil).ListWorkloadEndpoints(ctx, api.WorkloadEndpointMetadata{Node: "node1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoints.Items).To(HaveLen(2))
+		Expect(endpoints.Items[0].Metadata.Name).To(Equal("ep1"))
+
+		Expect(store.DeleteWorkloadEndpoint(ctx, endpoint("ep1").Metadata)).To(Succeed())
+		_, err = store.GetWorkloadEndpoint(ctx, endpoint("ep1").Metadata)
+		Expect(err).To(BeAssignableToTypeOf(libcalicoErrors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("assigns each address in the pools once", func() {
+		ipsV4, _, err := store.AutoAssign(ctx, datastoreClient.AutoAssignArgs{Num4: 3, Attrs: map[string]string{"endpoint": "ep1"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsV4).To(HaveLen(3))
+		Expect(ipsV4[0].String()).To(Equal("10.0.0.0"))
+
+		attributes, err := store.GetAssignmentAttributes(ctx, ipsV4[1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attributes).To(Equal(map[string]string{"endpoint": "ep1"}))
+
+		// Only 10.0.0.3 is left, so nothing is assigned.
+		_, _, err = store.AutoAssign(ctx, datastoreClient.AutoAssignArgs{Num4: 2})
+		Expect(err).To(MatchError(ContainSubstring("Only 1 of the 2 IPv4 addresses requested are free")))
+		Expect(store.AssignIP(ctx, datastoreClient.AssignIPArgs{IP: ipsV4[0]})).To(MatchError(ContainSubstring("already assigned")))
+
+		unallocated, err := store.ReleaseIPs(ctx, ipsV4[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(BeEmpty())
+		Expect(store.AssignIP(ctx, datastoreClient.AssignIPArgs{IP: ipsV4[0]})).To(Succeed())
+		Expect(store.AssignIP(ctx, datastoreClient.AssignIPArgs{IP: caliconet.IP{IP: net.ParseIP("10.0.1.1")}})).To(MatchError(ContainSubstring("isn't in any enabled IP pool")))
+	})
+})
+
+var _ = Describe("Datastore changes that complete after their deadline", func() {
+	var dir string
+	var local *Local
+	var release chan struct{}
+	var store *Client
+	var auditLog *audit.Log
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "datastore")
+		Expect(err).NotTo(HaveOccurred())
+		_, pool, err := caliconet.ParseCIDR("10.0.0.0/30")
+		Expect(err).NotTo(HaveOccurred())
+		local, err = OpenLocal(LocalConfig{
+			File:     filepath.Join(dir, "datastore.json"),
+			NodeName: "node1",
+			IPPools:  []caliconet.IPNet{*pool},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		release = make(chan struct{})
+		auditLog, err = audit.Open(filepath.Join(dir, "audit.log"))
+		Expect(err).NotTo(HaveOccurred())
+		store = NewClient(slowCalico{local, release}, auditLog)
+	})
+
+	outcomes := func() []string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+		Expect(err).NotTo(HaveOccurred())
+		var outcomes []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record audit.Record
+			Expect(json.Unmarshal([]byte(line), &record)).To(Succeed())
+			outcomes = append(outcomes, record.Operation+" "+record.Key+" "+record.Outcome)
+		}
+		return outcomes
+	}
+
+	AfterEach(func() {
+		auditLog.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("releases addresses assigned after the deadline", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err := store.AutoAssign(ctx, datastoreClient.AutoAssignArgs{Num4: 1})
+		Expect(timeoututils.IsTimeout(err)).To(BeTrue())
+
+		close(release)
+		assigned := func() int {
+			ips, _, err := local.IPAM().AutoAssign(datastoreClient.AutoAssignArgs{Num4: 4})
+			if err != nil {
+				return -1
+			}
+			_, err = local.IPAM().ReleaseIPs(ips)
+			Expect(err).NotTo(HaveOccurred())
+			return 4 - len(ips)
+		}
+		Eventually(assigned).Should(Equal(0))
+		Eventually(outcomes).Should(Equal([]string{
+			"AutoAssign ip/10.0.0.0 success",
+			"ReleaseIPs ip/10.0.0.0 success",
+		}))
+	})
+
+	It("records changes that weren't made as failed", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := store.AutoAssign(ctx, datastoreClient.AutoAssignArgs{Num4: 1})
+		Expect(err).To(HaveOccurred())
+		Expect(outcomes()).To(Equal([]string{"AutoAssign ip/auto failure"}))
+	})
+
+	It("doesn't record creating a profile that already exists", func() {
+		profile := &api.Profile{Metadata: api.ProfileMetadata{Name: "network1"}}
+		Expect(store.CreateProfile(context.Background(), profile)).To(Succeed())
+		Expect(store.CreateProfile(context.Background(), profile)).To(HaveOccurred())
+		Expect(outcomes()).To(Equal([]string{"CreateProfile profile/network1 success"}))
+	})
+})
+
+// slowCalico holds up address assignment until release is closed.
+type slowCalico struct {
+	*Local
+	release chan struct{}
+}
+
+func (s slowCalico) IPAM() datastoreClient.IPAMInterface {
+	return slowIPAM{s.Local.IPAM(), s.release}
+}
+
+type slowIPAM struct {
+	datastoreClient.IPAMInterface
+	release chan struct{}
+}
+
+func (i slowIPAM) AutoAssign(args datastoreClient.AutoAssignArgs) ([]caliconet.IP, []caliconet.IP, error) {
+	<-i.release
+	return i.IPAMInterface.AutoAssign(args)
+}
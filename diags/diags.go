@@ -0,0 +1,392 @@
+package diags
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/config"
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// Only the end of each log file is collected.
+	maxLogBytes = 1024 * 1024
+)
+
+// Options describes the plugin the diagnostics are collected for.
+type Options struct {
+	Version string
+
+	// Settings are the plugin's own settings, and Config its datastore
+	// config.
+	Settings     interface{}
+	Config       *api.CalicoAPIConfig
+	Node         string
+	Orchestrator string
+
+	// LogFile is the plugin's -log-file, if it logs to one.  The file and its
+	// most recent backup are collected.
+	LogFile string
+
+	// Timeout bounds each datastore and netlink step.
+	Timeout time.Duration
+}
+
+// bundle is the tarball being written.  A step that fails doesn't stop the
+// others; its error is added to errors.txt instead.
+type bundle struct {
+	tar     *tar.Writer
+	now     time.Time
+	secrets []string
+	errors  []string
+}
+
+// Collect writes a gzipped tarball of everything support needs to look into a
+// problem with the plugin on this host: its version and configuration, the
+// veths and routes on the host, the node's WorkloadEndpoints, the IP pools and
+// the IPAM allocations of those endpoints, and recent logs.  Passwords, tokens
+// and other secrets are redacted wherever they appear.
+func Collect(ctx context.Context, w io.Writer, store *datastore.Client, opts Options) error {
+	gz := gzip.NewWriter(w)
+	b := &bundle{tar: tar.NewWriter(gz), now: time.Now(), secrets: secrets(opts.Config, os.Environ())}
+
+	b.add("version.txt", []byte(opts.Version+"\n"), nil)
+	b.addJSON("settings.json", opts.Settings, nil)
+	b.addJSON("config.json", config.RedactDatastore(opts.Config), nil)
+	b.add("environment.txt", []byte(strings.Join(redactEnvironment(os.Environ()), "\n")+"\n"), nil)
+	b.collectNetlink(ctx, opts.Timeout)
+	b.collectDatastore(ctx, store, opts)
+	b.collectLogs(opts.LogFile)
+
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"), nil)
+	}
+	if err := b.tar.Close(); err != nil {
+		return errors.Wrap(err, "Diagnostics bundle writing error")
+	}
+	return errors.Wrap(gz.Close(), "Diagnostics bundle writing error")
+}
+
+// add writes a file to the bundle, or records err if the data couldn't be
+// collected.
+func (b *bundle) add(name string, data []byte, err error) {
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%v: %v", name, err))
+		return
+	}
+	data = []byte(b.redact(string(data)))
+	if err := b.tar.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	}); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%v: %v", name, err))
+		return
+	}
+	if _, err := b.tar.Write(data); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%v: %v", name, err))
+	}
+}
+
+func (b *bundle) addJSON(name string, v interface{}, err error) {
+	if err != nil {
+		b.add(name, nil, err)
+		return
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	b.add(name, append(data, '\n'), errors.Wrapf(err, "%v encoding error", name))
+}
+
+// redact replaces every known secret value in s.
+func (b *bundle) redact(s string) string {
+	for _, secret := range b.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// Link is a veth on the host.
+type Link struct {
+	Name         string   `json:"name"`
+	Index        int      `json:"index"`
+	MTU          int      `json:"mtu"`
+	HardwareAddr string   `json:"hardwareAddr"`
+	Flags        string   `json:"flags"`
+	Addresses    []string `json:"addresses"`
+}
+
+// Route is a route on the host.
+type Route struct {
+	Dst       string `json:"dst"`
+	Gw        string `json:"gw,omitempty"`
+	Src       string `json:"src,omitempty"`
+	LinkIndex int    `json:"linkIndex"`
+	Scope     uint8  `json:"scope"`
+	Protocol  int    `json:"protocol"`
+	Priority  int    `json:"priority"`
+}
+
+func (b *bundle) collectNetlink(ctx context.Context, timeout time.Duration) {
+	var links []Link
+	b.addJSON("veths.json", &links, run(ctx, timeout, "netlink link listing", func() error {
+		all, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range all {
+			if link.Type() != "veth" {
+				continue
+			}
+			attrs := link.Attrs()
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return errors.Wrapf(err, "Link %v address listing error", attrs.Name)
+			}
+			l := Link{
+				Name:         attrs.Name,
+				Index:        attrs.Index,
+				MTU:          attrs.MTU,
+				HardwareAddr: attrs.HardwareAddr.String(),
+				Flags:        attrs.Flags.String(),
+				Addresses:    []string{},
+			}
+			for _, addr := range addrs {
+				if addr.IPNet != nil {
+					l.Addresses = append(l.Addresses, addr.IPNet.String())
+				}
+			}
+			links = append(links, l)
+		}
+		return nil
+	}))
+
+	var routes []Route
+	b.addJSON("routes.json", &routes, run(ctx, timeout, "netlink route listing", func() error {
+		all, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, route := range all {
+			r := Route{
+				Dst:       "default",
+				LinkIndex: route.LinkIndex,
+				Scope:     route.Scope,
+				Protocol:  route.Protocol,
+				Priority:  route.Priority,
+			}
+			if route.Dst != nil {
+				r.Dst = route.Dst.String()
+			}
+			if route.Gw != nil {
+				r.Gw = route.Gw.String()
+			}
+			if route.Src != nil {
+				r.Src = route.Src.String()
+			}
+			routes = append(routes, r)
+		}
+		return nil
+	}))
+}
+
+// Allocation is the IPAM allocation of an address of one of the node's
+// WorkloadEndpoints.  libcalico-go doesn't expose the IPAM blocks themselves,
+// so these are collected instead.
+type Allocation struct {
+	Address    string            `json:"address"`
+	Endpoint   string            `json:"endpoint"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func (b *bundle) collectDatastore(ctx context.Context, store *datastore.Client, opts Options) {
+	if store == nil {
+		b.add("datastore", nil, errors.New("Datastore client unavailable"))
+		return
+	}
+
+	pools, err := withTimeout(ctx, opts.Timeout, func(ctx context.Context) (interface{}, error) {
+		return store.ListIPPools(ctx, api.IPPoolMetadata{})
+	})
+	b.addJSON("ip-pools.json", pools, errors.Wrap(err, "IP pools listing error"))
+
+	result, err := withTimeout(ctx, opts.Timeout, func(ctx context.Context) (interface{}, error) {
+		return store.ListWorkloadEndpoints(ctx, api.WorkloadEndpointMetadata{
+			Node:         opts.Node,
+			Orchestrator: opts.Orchestrator,
+		})
+	})
+	if err != nil {
+		b.add("workload-endpoints.json", nil, errors.Wrap(err, "WorkloadEndpoints listing error"))
+		return
+	}
+	endpoints := result.(*api.WorkloadEndpointList)
+	b.addJSON("workload-endpoints.json", endpoints, nil)
+
+	allocations := []Allocation{}
+	for _, endpoint := range endpoints.Items {
+		for _, ipNet := range endpoint.Spec.IPNetworks {
+			a := Allocation{Address: ipNet.IP.String(), Endpoint: endpoint.Metadata.Name}
+			attributes, err := withTimeout(ctx, opts.Timeout, func(ctx context.Context) (interface{}, error) {
+				return store.GetAssignmentAttributes(ctx, caliconet.IP{IP: ipNet.IP})
+			})
+			if err != nil {
+				a.Error = err.Error()
+			} else {
+				a.Attributes = attributes.(map[string]string)
+			}
+			allocations = append(allocations, a)
+		}
+	}
+	b.addJSON("ipam-allocations.json", allocations, nil)
+}
+
+func (b *bundle) collectLogs(path string) {
+	if path == "" {
+		b.add("logs", nil, errors.New("No -log-file given; the plugin logs to stderr, so use docker logs or journalctl to collect them"))
+		return
+	}
+	for _, p := range []string{path, path + ".1"} {
+		data, err := tail(p, maxLogBytes)
+		if os.IsNotExist(errors.Cause(err)) && p != path {
+			continue
+		}
+		b.add("logs/"+baseName(p), data, err)
+	}
+}
+
+// tail reads up to the last n bytes of the file at path.
+func tail(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Log file %v opening error", path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Log file %v reading error", path)
+	}
+	if info.Size() > n {
+		if _, err := f.Seek(info.Size()-n, io.SeekStart); err != nil {
+			return nil, errors.Wrapf(err, "Log file %v reading error", path)
+		}
+	}
+	data, err := ioutil.ReadAll(f)
+	return data, errors.Wrapf(err, "Log file %v reading error", path)
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func run(ctx context.Context, timeout time.Duration, step string, f func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return timeoututils.Run(ctx, step, f)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return f(ctx)
+}
+
+// Secrets and their redaction.
+
+// secretNames are the parts of environment variable names whose values are
+// never collected.
+var secretNames = []string{"PASSWORD", "TOKEN", "SECRET", "PASSPHRASE"}
+
+// secrets returns the secret values in the datastore config and environment,
+// so that they can be redacted wherever else they appear, e.g. in logs.
+func secrets(config *api.CalicoAPIConfig, environ []string) []string {
+	var values []string
+	if config != nil {
+		values = append(values, config.Spec.EtcdPassword, config.Spec.K8sAPIToken)
+	}
+	for _, kv := range environ {
+		if name, value := splitEnv(kv); isSecretName(name) {
+			values = append(values, value)
+		}
+	}
+
+	// Replace longer secrets first, in case one contains another.
+	var nonEmpty []string
+	for _, value := range values {
+		if value != "" {
+			nonEmpty = append(nonEmpty, value)
+		}
+	}
+	sort.Sort(byLength(nonEmpty))
+	return nonEmpty
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// redactEnvironment returns the environment variables relevant to the plugin,
+// sorted, with the values of secret ones redacted.
+func redactEnvironment(environ []string) []string {
+	var vars []string
+	for _, kv := range environ {
+		name, _ := splitEnv(kv)
+		if !isRelevantName(name) {
+			continue
+		}
+		if isSecretName(name) {
+			kv = name + "=" + redacted
+		}
+		vars = append(vars, kv)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+func splitEnv(kv string) (string, string) {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}
+
+func isRelevantName(name string) bool {
+	for _, prefix := range []string{"CALICO_", "ETCD_", "K8S_", "KUBECONFIG", "DATASTORE_", "DOCKER_", "HOSTNAME", "NODENAME"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSecretName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, secret := range secretNames {
+		if strings.Contains(upper, secret) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package diags
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDiags(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Diags Suite")
+}
@@ -0,0 +1,113 @@
+package diags
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+)
+
+// untar returns the contents of each file in a gzipped tarball.
+func untar(data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	Expect(err).NotTo(HaveOccurred())
+	r := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return files
+		}
+		Expect(err).NotTo(HaveOccurred())
+		contents, err := ioutil.ReadAll(r)
+		Expect(err).NotTo(HaveOccurred())
+		files[header.Name] = string(contents)
+	}
+}
+
+var _ = Describe("Diagnostics bundle", func() {
+	var dir string
+	var config *api.CalicoAPIConfig
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "diags")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = api.NewCalicoAPIConfig()
+		config.Spec.EtcdEndpoints = "https://etcd:2379"
+		config.Spec.EtcdUsername = "calico"
+		config.Spec.EtcdPassword = "hunter2"
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	collect := func(opts Options) map[string]string {
+		var buf bytes.Buffer
+		Expect(Collect(context.Background(), &buf, nil, opts)).To(Succeed())
+		return untar(buf.Bytes())
+	}
+
+	It("collects the version and config without secrets", func() {
+		files := collect(Options{Version: "v1.2.3", Config: config, Timeout: time.Second})
+		Expect(files["version.txt"]).To(Equal("v1.2.3\n"))
+		Expect(files["config.json"]).To(ContainSubstring("https://etcd:2379"))
+		Expect(files["config.json"]).To(ContainSubstring(redacted))
+		Expect(files["config.json"]).NotTo(ContainSubstring("hunter2"))
+	})
+
+	It("collects the end of the log file with secrets redacted", func() {
+		logFile := filepath.Join(dir, "plugin.log")
+		Expect(ioutil.WriteFile(logFile, []byte("connecting as calico:hunter2\n"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(logFile+".1", []byte("older\n"), 0600)).To(Succeed())
+
+		files := collect(Options{Config: config, LogFile: logFile, Timeout: time.Second})
+		Expect(files["logs/plugin.log"]).To(Equal("connecting as calico:" + redacted + "\n"))
+		Expect(files["logs/plugin.log.1"]).To(Equal("older\n"))
+	})
+
+	It("lists what couldn't be collected", func() {
+		files := collect(Options{Config: config, Timeout: time.Second})
+		Expect(files["errors.txt"]).To(ContainSubstring("Datastore client unavailable"))
+		Expect(files["errors.txt"]).To(ContainSubstring("No -log-file given"))
+	})
+
+	It("only reads the end of large files", func() {
+		path := filepath.Join(dir, "big.log")
+		Expect(ioutil.WriteFile(path, []byte(strings.Repeat("a", 100)+"end"), 0600)).To(Succeed())
+		data, err := tail(path, 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("end"))
+	})
+})
+
+var _ = Describe("Environment redaction", func() {
+	It("keeps only relevant variables and redacts secret ones", func() {
+		Expect(redactEnvironment([]string{
+			"PATH=/bin",
+			"ETCD_PASSWORD=hunter2",
+			"CALICO_LIBNETWORK_IFPREFIX=cali",
+			"K8S_API_TOKEN=abc",
+		})).To(Equal([]string{
+			"CALICO_LIBNETWORK_IFPREFIX=cali",
+			"ETCD_PASSWORD=" + redacted,
+			"K8S_API_TOKEN=" + redacted,
+		}))
+	})
+
+	It("redacts secret values longest first", func() {
+		Expect(secrets(nil, []string{"A_TOKEN=abc", "B_SECRET=abcdef", "C_TOKEN="})).To(Equal([]string{"abcdef", "abc"}))
+	})
+})
@@ -0,0 +1,362 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	eventsutils "github.com/projectcalico/libnetwork-plugin/utils/events"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+)
+
+// Run with "go test -race" so that the race detector checks the drivers too.
+var _ = Describe("Concurrent driver calls", func() {
+	var fake *fakeCalico
+	var retries *retryutils.Queue
+	var retryDir string
+
+	BeforeEach(func() {
+		fake = newFakeCalico()
+
+		var err error
+		retryDir, err = ioutil.TempDir("", "retries")
+		Expect(err).NotTo(HaveOccurred())
+		retries, err = retryutils.Open(filepath.Join(retryDir, "queue.json"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(retryDir)).To(Succeed())
+	})
+
+	It("serializes network driver calls for the same endpoint", func() {
+		d := NewNetworkDriver(datastore.NewClient(fake, nil), nil, eventsutils.NewWatcher(nil), retries, NewSettings(DefaultConfig())).(NetworkDriver)
+		d.networks.set("network", networkInfo{Name: "network"})
+
+		hammer(func(i int) {
+			endpointID := fmt.Sprintf("endpoint%d", i%5)
+			if i%2 == 0 {
+				_, _ = d.CreateEndpoint(&network.CreateEndpointRequest{
+					NetworkID:  "network",
+					EndpointID: endpointID,
+					Interface:  &network.EndpointInterface{Address: fmt.Sprintf("192.168.0.%d/32", i%5)},
+				})
+			} else {
+				_ = d.DeleteEndpoint(&network.DeleteEndpointRequest{
+					NetworkID:  "network",
+					EndpointID: endpointID,
+				})
+			}
+		})
+
+		Expect(fake.overlapping()).To(BeEmpty())
+		Expect(fake.maxInFlight()).To(BeNumerically(">", 1))
+	})
+
+	It("serializes IPAM driver calls for the same address", func() {
+		i := NewIpamDriver(datastore.NewClient(fake, nil), retries, NewSettings(DefaultConfig()))
+
+		hammer(func(n int) {
+			address := fmt.Sprintf("192.168.0.%d", n%5)
+			if n%2 == 0 {
+				_, _ = i.RequestAddress(&ipam.RequestAddressRequest{PoolID: PoolIDV4, Address: address})
+			} else {
+				_ = i.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: PoolIDV4, Address: address})
+			}
+		})
+
+		Expect(fake.overlapping()).To(BeEmpty())
+		Expect(fake.maxInFlight()).To(BeNumerically(">", 1))
+	})
+
+	Describe("a queued release of an address that is assigned again", func() {
+		var i IpamDriver
+		var address string
+		var retried chan error
+		var unlock func()
+
+		// Queue the release and start retrying it while the address's lock
+		// is held, so that the retry waits.
+		BeforeEach(func() {
+			i = NewIpamDriver(datastore.NewClient(fake, nil), retries, NewSettings(DefaultConfig())).(IpamDriver)
+			address = "192.168.0.1"
+			Expect(retries.Add(retryReleaseAddress, address, nil, fmt.Errorf("etcd unavailable"))).To(Succeed())
+			op := retries.Operations()[0]
+
+			unlock = i.locks.Lock(address)
+			retried = make(chan error)
+			go func() { retried <- i.retryReleaseAddress(op) }()
+			Eventually(func() int { return i.locks.Held()[address].Waiters }).Should(Equal(1))
+		})
+
+		request := func(req *ipam.RequestAddressRequest) chan struct{} {
+			requested := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(requested)
+				resp, err := i.RequestAddress(req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Address).To(Equal(address + "/32"))
+			}()
+			return requested
+		}
+
+		It("isn't released once it is requested", func() {
+			requested := request(&ipam.RequestAddressRequest{PoolID: PoolIDV4, Address: address})
+			Eventually(func() int { return i.locks.Held()[address].Waiters }).Should(Equal(2))
+
+			// Whichever gets the lock first, the address stays assigned.
+			unlock()
+			Eventually(requested).Should(BeClosed())
+			Eventually(retried).Should(Receive(BeNil()))
+			Expect(retries.Len()).To(Equal(0))
+			Expect(fake.assigned(address)).To(BeTrue())
+		})
+
+		It("isn't released once it is automatically assigned", func() {
+			requested := request(&ipam.RequestAddressRequest{PoolID: PoolIDV4})
+			Consistently(requested).ShouldNot(BeClosed())
+
+			unlock()
+			Eventually(requested).Should(BeClosed())
+			Eventually(retried).Should(Receive(BeNil()))
+			Expect(retries.Len()).To(Equal(0))
+			Expect(fake.assigned(address)).To(BeTrue())
+		})
+	})
+})
+
+// hammer calls f concurrently with a range of values, returning once all the
+// calls are complete.
+func hammer(f func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer GinkgoRecover()
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// fakeCalico is an in-memory datastore that records any operations that run
+// concurrently on the same object.  Each operation takes a little time so that
+// unserialized calls are very likely to overlap.
+type fakeCalico struct {
+	mutex     sync.Mutex
+	inFlight  map[string]bool
+	overlaps  []string
+	maxActive int
+
+	endpoints map[string]api.WorkloadEndpoint
+	ips       map[string]bool
+}
+
+func newFakeCalico() *fakeCalico {
+	return &fakeCalico{
+		inFlight:  map[string]bool{},
+		endpoints: map[string]api.WorkloadEndpoint{},
+		ips:       map[string]bool{},
+	}
+}
+
+// begin marks an operation on key as in progress, returning the function that
+// marks it complete.
+func (f *fakeCalico) begin(key string) func() {
+	f.mutex.Lock()
+	if f.inFlight[key] {
+		f.overlaps = append(f.overlaps, key)
+	}
+	f.inFlight[key] = true
+	if len(f.inFlight) > f.maxActive {
+		f.maxActive = len(f.inFlight)
+	}
+	f.mutex.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.inFlight, key)
+	}
+}
+
+func (f *fakeCalico) overlapping() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.overlaps
+}
+
+func (f *fakeCalico) assigned(address string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.ips[address]
+}
+
+func (f *fakeCalico) maxInFlight() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.maxActive
+}
+
+func (f *fakeCalico) Nodes() datastoreClient.NodeInterface {
+	return nil
+}
+
+func (f *fakeCalico) Profiles() datastoreClient.ProfileInterface {
+	return fakeProfiles{}
+}
+
+func (f *fakeCalico) WorkloadEndpoints() datastoreClient.WorkloadEndpointInterface {
+	return fakeWorkloadEndpoints{f}
+}
+
+func (f *fakeCalico) IPPools() datastoreClient.IPPoolInterface {
+	return nil
+}
+
+func (f *fakeCalico) IPAM() datastoreClient.IPAMInterface {
+	return fakeIPAM{f}
+}
+
+type fakeProfiles struct {
+	datastoreClient.ProfileInterface
+}
+
+func (p fakeProfiles) Create(profile *api.Profile) (*api.Profile, error) {
+	return profile, nil
+}
+
+type fakeWorkloadEndpoints struct {
+	*fakeCalico
+}
+
+func (w fakeWorkloadEndpoints) List(metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpointList, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	list := api.NewWorkloadEndpointList()
+	for _, endpoint := range w.endpoints {
+		if (metadata.Node == "" || endpoint.Metadata.Node == metadata.Node) &&
+			(metadata.Orchestrator == "" || endpoint.Metadata.Orchestrator == metadata.Orchestrator) &&
+			(metadata.Workload == "" || endpoint.Metadata.Workload == metadata.Workload) {
+			list.Items = append(list.Items, endpoint)
+		}
+	}
+	return list, nil
+}
+
+func (w fakeWorkloadEndpoints) Get(metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpoint, error) {
+	panic("not implemented")
+}
+
+func (w fakeWorkloadEndpoints) Create(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	defer w.begin("endpoint/" + endpoint.Metadata.Name)()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.endpoints[endpoint.Metadata.Name]; ok {
+		return nil, libcalicoErrors.ErrorResourceAlreadyExists{Identifier: endpoint.Metadata}
+	}
+	w.endpoints[endpoint.Metadata.Name] = *endpoint
+	return endpoint, nil
+}
+
+func (w fakeWorkloadEndpoints) Update(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	panic("not implemented")
+}
+
+func (w fakeWorkloadEndpoints) Apply(endpoint *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
+	panic("not implemented")
+}
+
+func (w fakeWorkloadEndpoints) Delete(metadata api.WorkloadEndpointMetadata) error {
+	defer w.begin("endpoint/" + metadata.Name)()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	endpoint, ok := w.endpoints[metadata.Name]
+	if !ok || endpoint.Metadata.Orchestrator != metadata.Orchestrator || endpoint.Metadata.Workload != metadata.Workload {
+		return libcalicoErrors.ErrorResourceDoesNotExist{Identifier: metadata}
+	}
+	delete(w.endpoints, metadata.Name)
+	return nil
+}
+
+type fakeIPAM struct {
+	*fakeCalico
+}
+
+func (i fakeIPAM) AssignIP(args datastoreClient.AssignIPArgs) error {
+	defer i.begin("ip/" + args.IP.String())()
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.ips[args.IP.String()] {
+		return fmt.Errorf("Address %v is already assigned", args.IP)
+	}
+	i.ips[args.IP.String()] = true
+	return nil
+}
+
+// AutoAssign assigns the first free address in 192.168.0.0/24.
+func (i fakeIPAM) AutoAssign(args datastoreClient.AutoAssignArgs) ([]caliconet.IP, []caliconet.IP, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for n := 1; n < 255; n++ {
+		ip := caliconet.IP{IP: net.ParseIP(fmt.Sprintf("192.168.0.%d", n))}
+		if !i.ips[ip.String()] {
+			i.ips[ip.String()] = true
+			return []caliconet.IP{ip}, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("No free addresses")
+}
+
+func (i fakeIPAM) ReleaseIPs(ips []caliconet.IP) ([]caliconet.IP, error) {
+	var unallocated []caliconet.IP
+	for _, ip := range ips {
+		done := i.begin("ip/" + ip.String())
+		i.mutex.Lock()
+		if !i.ips[ip.String()] {
+			unallocated = append(unallocated, ip)
+		}
+		delete(i.ips, ip.String())
+		i.mutex.Unlock()
+		done()
+	}
+	return unallocated, nil
+}
+
+func (i fakeIPAM) GetAssignmentAttributes(addr caliconet.IP) (map[string]string, error) {
+	panic("not implemented")
+}
+
+func (i fakeIPAM) IPsByHandle(handleID string) ([]caliconet.IP, error) {
+	panic("not implemented")
+}
+
+func (i fakeIPAM) ReleaseByHandle(handleID string) error {
+	panic("not implemented")
+}
+
+func (i fakeIPAM) ClaimAffinity(cidr caliconet.IPNet, host string) ([]caliconet.IPNet, []caliconet.IPNet, error) {
+	panic("not implemented")
+}
+
+func (i fakeIPAM) ReleaseAffinity(cidr caliconet.IPNet, host string) error {
+	panic("not implemented")
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings of the network and IPAM drivers.
+type Config struct {
+	// NodeName is the node that endpoints are created on, which is resolved
+	// once at startup.
+	NodeName string
+
+	// InterfacePrefix starts the name Docker gives the container side of each
+	// veth, e.g. "cali0".  The host side is always named "cali" followed by
+	// the start of the endpoint ID.
+	InterfacePrefix string
+
+	// DockerFallback is what to do when the Docker API can't be used to look
+	// up a network name: DockerFallbackError or DockerFallbackNetworkID.
+	DockerFallback string
+
+	// The MAC address of the interface in the container is arbitrary, so for
+	// simplicity, a fixed one is used.
+	MACAddress string
+
+	// GatewayIPv4 is the next hop of the default route in each container.
+	GatewayIPv4 string
+
+	// AllowOtherIPAM lets networks use IPAM drivers other than Calico's, e.g.
+	// when the Calico IPAM driver isn't being served.
+	AllowOtherIPAM bool
+
+	// Orchestrator and workload IDs used in our endpoint identification.
+	// Unique endpoint identification is provided by hostname and endpoint ID.
+	// Changing them orphans the endpoints that already exist.
+	OrchestratorID string
+	WorkloadID     string
+
+	// RPCTimeout bounds the time spent on the datastore and Docker operations
+	// made for a single libnetwork RPC, so that a hung datastore can't block
+	// Docker.
+	RPCTimeout time.Duration
+
+	// The traffic allowed by the profile created for each new network:
+	// ProfileIngressNetwork, ProfileAll or ProfileNone for ingress, and
+	// ProfileAll or ProfileNone for egress.  Existing profiles aren't changed.
+	ProfileIngress string
+	ProfileEgress  string
+
+	// Endpoints created more recently than OrphanGracePeriod are never treated
+	// as orphaned, since Docker may not have attached them to their container
+	// yet.  Orphaned endpoints are swept OrphanSweepDelay after the removal
+	// that asked for it, so that a burst of removals only causes one sweep,
+	// and at least every OrphanSweepInterval in case a removal was missed.
+	OrphanGracePeriod   time.Duration
+	OrphanSweepDelay    time.Duration
+	OrphanSweepInterval time.Duration
+}
+
+// DefaultConfig returns the settings used when nothing else is configured.
+func DefaultConfig() Config {
+	return Config{
+		InterfacePrefix: "cali",
+		DockerFallback:  DockerFallbackError,
+		MACAddress:      "EE:EE:EE:EE:EE:EE",
+		GatewayIPv4:     "169.254.1.1",
+		OrchestratorID:  "libnetwork",
+		WorkloadID:      "libnetwork",
+		RPCTimeout:      25 * time.Second,
+
+		ProfileIngress: ProfileIngressNetwork,
+		ProfileEgress:  ProfileAll,
+
+		OrphanGracePeriod:   time.Minute,
+		OrphanSweepDelay:    10 * time.Second,
+		OrphanSweepInterval: 10 * time.Minute,
+	}
+}
+
+// Settings holds the driver settings, which can be replaced while the drivers
+// are serving, e.g. when the config is reloaded.  Each request uses the
+// settings that were current when it started.
+type Settings struct {
+	value atomic.Value
+
+	mutex   sync.Mutex
+	changed chan struct{}
+}
+
+// NewSettings holds the given settings.
+func NewSettings(config Config) *Settings {
+	s := &Settings{changed: make(chan struct{})}
+	s.value.Store(config)
+	return s
+}
+
+// Load returns the current settings.
+func (s *Settings) Load() Config {
+	return s.value.Load().(Config)
+}
+
+// Store replaces the settings, for the requests that start afterwards.
+func (s *Settings) Store(config Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.value.Store(config)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed the next time the settings are
+// replaced, for long running tasks that need to notice.
+func (s *Settings) Changed() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.changed
+}
@@ -0,0 +1,21 @@
+package driver
+
+import (
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDriver(t *testing.T) {
+	// The drivers log every request, which isn't useful here.
+	log.SetOutput(ioutil.Discard)
+	networkLog.Out = ioutil.Discard
+	ipamLog.Out = ioutil.Discard
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Driver Suite")
+}
@@ -0,0 +1,292 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/docker/docker/api/types"
+	dockerEvents "github.com/docker/docker/api/types/events"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	eventsutils "github.com/projectcalico/libnetwork-plugin/utils/events"
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
+)
+
+// Container labels with this prefix are copied, minus the prefix, onto the
+// container's WorkloadEndpoints so that they can be used in policy selectors.
+const labelPrefix = "org.projectcalico.label."
+
+// recentEndpoints records when endpoints were created by this process.
+type recentEndpoints struct {
+	mutex   sync.Mutex
+	created map[string]time.Time
+}
+
+func newRecentEndpoints() *recentEndpoints {
+	return &recentEndpoints{created: map[string]time.Time{}}
+}
+
+func (r *recentEndpoints) add(endpointID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.created[endpointID] = time.Now()
+}
+
+// contains reports whether the endpoint was created within the grace period,
+// forgetting about any endpoints that are older than that.
+func (r *recentEndpoints) contains(endpointID string, gracePeriod time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, created := range r.created {
+		if time.Since(created) > gracePeriod {
+			delete(r.created, id)
+		}
+	}
+	_, ok := r.created[endpointID]
+	return ok
+}
+
+// registerEventHandlers subscribes the driver to the Docker events it acts on.
+// Each event is handled under the same deadline as an RPC, so that a hung
+// datastore can't stall the event stream indefinitely.
+func (d NetworkDriver) registerEventHandlers(watcher *eventsutils.Watcher) {
+	watcher.Handle(dockerEvents.NetworkEventType, d.handleNetworkEvent)
+	watcher.Handle(dockerEvents.ContainerEventType, d.handleContainerEvent)
+
+	// Removals may have been missed while the event stream was down.
+	watcher.OnResync(d.networks.flush)
+}
+
+func (d NetworkDriver) handleNetworkEvent(msg dockerEvents.Message) {
+	config := d.settings.Load()
+	ctx, cancel := context.WithTimeout(logutils.WithCorrelationID(context.Background(), msg.Actor.ID), config.RPCTimeout)
+	defer cancel()
+
+	switch msg.Action {
+	case "destroy", "remove":
+		networkLog.WithContext(ctx).Debugf("Network %v removed, invalidating cached details", msg.Actor.ID)
+		d.networks.invalidate(msg.Actor.ID)
+		d.requestOrphanSweep()
+	}
+}
+
+func (d NetworkDriver) handleContainerEvent(msg dockerEvents.Message) {
+	config := d.settings.Load()
+	ctx, cancel := context.WithTimeout(logutils.WithCorrelationID(context.Background(), msg.Actor.ID), config.RPCTimeout)
+	defer cancel()
+
+	switch msg.Action {
+	case "start":
+		d.updateEndpointLabels(ctx, msg.Actor.ID)
+	case "destroy":
+		d.requestOrphanSweep()
+	}
+}
+
+// updateEndpointLabels copies the container's Calico labels onto the
+// WorkloadEndpoints for each of its Calico networks.
+func (d NetworkDriver) updateEndpointLabels(ctx context.Context, containerID string) {
+	config := d.settings.Load()
+	_, span := traceutils.StartSpan(ctx, "Docker container inspection", traceutils.KindClient)
+	span.SetAttribute("container.id", containerID)
+	container, err := d.dockerCli.ContainerInspect(ctx, containerID)
+	err = timeoututils.Check(ctx, "Docker container inspection", err)
+	span.Finish(err)
+	if err != nil {
+		networkLog.WithContext(ctx).Errorln(errors.Wrapf(err, "Container %v inspection error", containerID))
+		return
+	}
+	if container.Config == nil || container.NetworkSettings == nil {
+		return
+	}
+
+	labels := map[string]string{}
+	for key, value := range container.Config.Labels {
+		if strings.HasPrefix(key, labelPrefix) {
+			labels[strings.TrimPrefix(key, labelPrefix)] = value
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+
+	hostname := config.NodeName
+
+	for _, settings := range container.NetworkSettings.Networks {
+		if settings == nil || settings.EndpointID == "" {
+			continue
+		}
+		d.updateEndpoint(ctx, settings.EndpointID, containerID, hostname, labels)
+	}
+}
+
+func (d NetworkDriver) updateEndpoint(ctx context.Context, endpointID, containerID, hostname string, labels map[string]string) {
+	config := d.settings.Load()
+	defer d.locks.Lock(endpointID)()
+	ctx = audit.WithRequest(ctx, "UpdateEndpointLabels", endpointID, "")
+
+	endpoint, err := d.client.GetWorkloadEndpoint(ctx, api.WorkloadEndpointMetadata{
+		Name:         endpointID,
+		Node:         hostname,
+		Orchestrator: config.OrchestratorID,
+		Workload:     config.WorkloadID})
+	if err != nil {
+		// Endpoints on networks using other drivers won't be in the datastore.
+		if _, ok := err.(libcalicoErrors.ErrorResourceDoesNotExist); !ok {
+			networkLog.WithContext(ctx).Errorln(errors.Wrapf(err, "Endpoint %v fetching error", endpointID))
+		}
+		return
+	}
+
+	if endpoint.Metadata.Labels == nil {
+		endpoint.Metadata.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		endpoint.Metadata.Labels[key] = value
+	}
+	if err := d.client.UpdateWorkloadEndpoint(ctx, endpoint); err != nil {
+		networkLog.WithContext(ctx).Errorln(errors.Wrapf(err, "Endpoint %v labels update error", endpointID))
+		return
+	}
+	networkLog.WithContext(ctx).Debugf("Updated labels on endpoint %v for container %v: %v", endpointID, containerID, labels)
+}
+
+// requestOrphanSweep asks for orphaned endpoints to be swept without waiting
+// for it, since a sweep inspects every network and would hold up the event
+// stream.
+func (d NetworkDriver) requestOrphanSweep() {
+	select {
+	case d.sweeps <- struct{}{}:
+	default:
+		// A sweep has already been asked for.
+	}
+}
+
+// RunOrphanSweeps sweeps orphaned endpoints after the removals that ask for it
+// and periodically, until stop is closed.
+func (d NetworkDriver) RunOrphanSweeps(stop <-chan struct{}) {
+	d.runSweeps(stop, func() {
+		config := d.settings.Load()
+		ctx, cancel := context.WithTimeout(logutils.WithCorrelationID(context.Background(), "orphan-sweep"), config.RPCTimeout)
+		d.cleanOrphanedEndpoints(ctx)
+		cancel()
+	})
+}
+
+// runSweeps calls sweep when RunOrphanSweeps should sweep, restarting the
+// periodic sweeps whenever their interval is changed.
+func (d NetworkDriver) runSweeps(stop <-chan struct{}, sweep func()) {
+	changed := d.settings.Changed()
+	interval := d.settings.Load().OrphanSweepInterval
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changed:
+			changed = d.settings.Changed()
+			if next := d.settings.Load().OrphanSweepInterval; next != interval {
+				interval = next
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+			continue
+		case <-ticker.C:
+		case <-d.sweeps:
+			select {
+			case <-stop:
+				return
+			case <-time.After(d.settings.Load().OrphanSweepDelay):
+			}
+			// Removals during the delay are covered by this sweep.
+			select {
+			case <-d.sweeps:
+			default:
+			}
+		}
+		sweep()
+	}
+}
+
+// cleanOrphanedEndpoints removes WorkloadEndpoints on this host that Docker no
+// longer knows about, for example because DeleteEndpoint failed or was never
+// called.  Their addresses are left to IPAM, since Docker may already have
+// handed them out again, or they may not have come from Calico IPAM at all.
+func (d NetworkDriver) cleanOrphanedEndpoints(ctx context.Context) {
+	config := d.settings.Load()
+	hostname := config.NodeName
+
+	known, err := d.dockerEndpoints(ctx)
+	if err != nil {
+		networkLog.WithContext(ctx).Errorln(errors.Wrap(err, "Orphaned endpoint check error"))
+		return
+	}
+
+	endpoints, err := d.client.ListWorkloadEndpoints(ctx, api.WorkloadEndpointMetadata{
+		Node:         hostname,
+		Orchestrator: config.OrchestratorID,
+		Workload:     config.WorkloadID})
+	if err != nil {
+		networkLog.WithContext(ctx).Errorln(errors.Wrap(err, "Workload endpoints listing error"))
+		return
+	}
+
+	for _, endpoint := range endpoints.Items {
+		if !known[endpoint.Metadata.Name] {
+			d.removeOrphanedEndpoint(ctx, endpoint)
+		}
+	}
+}
+
+func (d NetworkDriver) removeOrphanedEndpoint(ctx context.Context, endpoint api.WorkloadEndpoint) {
+	defer d.locks.Lock(endpoint.Metadata.Name)()
+	if d.recent.contains(endpoint.Metadata.Name, d.settings.Load().OrphanGracePeriod) {
+		return
+	}
+	ctx = audit.WithRequest(ctx, "RemoveOrphanedEndpoint", endpoint.Metadata.Name, "")
+
+	networkLog.WithContext(ctx).Infof("Removing orphaned endpoint %v", endpoint.Metadata.Name)
+	err := d.client.DeleteWorkloadEndpoint(ctx, endpoint.Metadata)
+	if _, ok := err.(libcalicoErrors.ErrorResourceDoesNotExist); err != nil && !ok {
+		networkLog.WithContext(ctx).Errorln(errors.Wrapf(err, "Endpoint %v removal error", endpoint.Metadata.Name))
+	}
+}
+
+// dockerEndpoints returns the IDs of all the endpoints Docker has on this host.
+func (d NetworkDriver) dockerEndpoints(ctx context.Context) (map[string]bool, error) {
+	_, span := traceutils.StartSpan(ctx, "Docker network listing", traceutils.KindClient)
+	networks, err := d.dockerCli.NetworkList(ctx, types.NetworkListOptions{})
+	err = timeoututils.Check(ctx, "Docker network listing", err)
+	span.Finish(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Network listing error")
+	}
+
+	endpoints := map[string]bool{}
+	for _, summary := range networks {
+		_, span := traceutils.StartSpan(ctx, "Docker network inspection", traceutils.KindClient)
+		span.SetAttribute("network.id", summary.ID)
+		networkData, err := d.dockerCli.NetworkInspect(ctx, summary.ID)
+		err = timeoututils.Check(ctx, "Docker network inspection", err)
+		span.Finish(err)
+		if dockerClient.IsErrNetworkNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Network %v inspection error", summary.ID)
+		}
+		for _, container := range networkData.Containers {
+			endpoints[container.EndpointID] = true
+		}
+	}
+	return endpoints, nil
+}
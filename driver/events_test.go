@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Orphaned endpoint sweeps", func() {
+	var settings *Settings
+	var d NetworkDriver
+	var stop, stopped chan struct{}
+	var swept chan struct{}
+
+	BeforeEach(func() {
+		config := DefaultConfig()
+		config.OrphanSweepInterval = time.Hour
+		config.OrphanSweepDelay = 0
+		settings = NewSettings(config)
+		d = NetworkDriver{settings: settings, sweeps: make(chan struct{}, 1)}
+
+		stop, stopped = make(chan struct{}), make(chan struct{})
+		swept = make(chan struct{}, 1)
+		go func(d NetworkDriver, stop, stopped, swept chan struct{}) {
+			defer close(stopped)
+			d.runSweeps(stop, func() {
+				select {
+				case swept <- struct{}{}:
+				default:
+				}
+			})
+		}(d, stop, stopped, swept)
+	})
+
+	AfterEach(func() {
+		close(stop)
+		<-stopped
+	})
+
+	It("sweeps after a removal asks for it", func() {
+		Consistently(swept, 50*time.Millisecond).ShouldNot(Receive())
+		d.requestOrphanSweep()
+		Eventually(swept).Should(Receive())
+	})
+
+	It("restarts the periodic sweeps when their interval is changed", func() {
+		Consistently(swept, 50*time.Millisecond).ShouldNot(Receive())
+
+		config := settings.Load()
+		config.OrphanSweepInterval = 10 * time.Millisecond
+		settings.Store(config)
+		Eventually(swept).Should(Receive())
+		Eventually(swept).Should(Receive())
+	})
+
+	It("uses the delay that is current when a removal asks for a sweep", func() {
+		config := settings.Load()
+		config.OrphanSweepDelay = time.Hour
+		settings.Store(config)
+		d.requestOrphanSweep()
+		Consistently(swept, 50*time.Millisecond).ShouldNot(Receive())
+	})
+})
@@ -1,53 +1,94 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
 	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
 	caliconet "github.com/projectcalico/libcalico-go/lib/net"
-	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
-	osutils "github.com/projectcalico/libnetwork-plugin/utils/os"
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	debugutils "github.com/projectcalico/libnetwork-plugin/utils/debug"
+	"github.com/projectcalico/libnetwork-plugin/utils/keylock"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
 )
 
 type IpamDriver struct {
-	client *datastoreClient.Client
+	client *datastore.Client
 
 	poolIDV4 string
 	poolIDV6 string
+
+	settings *Settings
+
+	// Calls for the same address are serialized on the address.
+	locks *keylock.Locker
+
+	// Automatic assignments hold this for reading until any queued release of
+	// the address they got has been dropped, and retried releases hold it for
+	// writing, so that a retried release can't free an address that has just
+	// been assigned before its lock is taken.
+	autoAssigning *sync.RWMutex
+
+	retries *retryutils.Queue
 }
 
-func NewIpamDriver(client *datastoreClient.Client) ipam.Ipam {
-	return IpamDriver{
+// NewIpamDriver creates the IPAM driver, registering its cleanup operations
+// with the retry queue.
+func NewIpamDriver(client *datastore.Client, retries *retryutils.Queue, settings *Settings) ipam.Ipam {
+	i := IpamDriver{
 		client: client,
 
 		poolIDV4: PoolIDV4,
 		poolIDV6: PoolIDV6,
+
+		settings: settings,
+		locks:    keylock.New(),
+		retries:  retries,
+
+		autoAssigning: &sync.RWMutex{},
 	}
+	retries.Register(retryReleaseAddress, i.retryReleaseAddress)
+	debugutils.RegisterState("ipamLocks", func() interface{} { return i.locks.Held() })
+	return i
 }
 
-func (i IpamDriver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+func (i IpamDriver) GetCapabilities() (_ *ipam.CapabilitiesResponse, err error) {
+	ctx, span := startRequest("ipam.GetCapabilities", "")
+	defer func() { span.Finish(err) }()
+	log := ipamLog.WithContext(ctx)
 	resp := ipam.CapabilitiesResponse{}
-	logutils.JSONMessage("GetCapabilities response", resp)
+	log.JSONMessage("GetCapabilities response", resp)
 	return &resp, nil
 }
 
-func (i IpamDriver) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+func (i IpamDriver) GetDefaultAddressSpaces() (_ *ipam.AddressSpacesResponse, err error) {
+	ctx, span := startRequest("ipam.GetDefaultAddressSpaces", "")
+	defer func() { span.Finish(err) }()
+	log := ipamLog.WithContext(ctx)
 	resp := &ipam.AddressSpacesResponse{
 		LocalDefaultAddressSpace:  "CalicoLocalAddressSpace",
 		GlobalDefaultAddressSpace: CalicoGlobalAddressSpace,
 	}
-	logutils.JSONMessage("GetDefaultAddressSpace response", resp)
+	log.JSONMessage("GetDefaultAddressSpace response", resp)
 	return resp, nil
 }
 
-func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
-	logutils.JSONMessage("RequestPool", request)
+func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (_ *ipam.RequestPoolResponse, err error) {
+	config := i.settings.Load()
+	ctx, span := startRequest("ipam.RequestPool", request.Pool)
+	defer func() { span.Finish(err) }()
+	log := ipamLog.WithContext(ctx)
+	log.JSONMessage("RequestPool", request)
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
 
 	// Calico IPAM does not allow you to request a SubPool.
 	if request.SubPool != "" {
@@ -74,7 +115,6 @@ func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (*ipam.Request
 	// If a pool (subnet on the CLI) is specified, it must match one of the
 	// preconfigured Calico pools.
 	if request.Pool != "" {
-		poolsClient := i.client.IPPools()
 		_, ipNet, err := caliconet.ParseCIDR(request.Pool)
 		if err != nil {
 			err := errors.New("Invalid CIDR")
@@ -82,8 +122,11 @@ func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (*ipam.Request
 			return nil, err
 		}
 
-		pools, err := poolsClient.List(api.IPPoolMetadata{CIDR: *ipNet})
-		if err != nil || len(pools.Items) < 1 {
+		pools, err := i.client.ListIPPools(ctx, api.IPPoolMetadata{CIDR: *ipNet})
+		if timeoututils.IsTimeout(err) {
+			log.Errorln(err)
+			return nil, err
+		} else if err != nil || len(pools.Items) < 1 {
 			err := errors.New("The requested subnet must match the CIDR of a " +
 				"configured Calico IP Pool.",
 			)
@@ -104,36 +147,43 @@ func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (*ipam.Request
 		Data:   map[string]string{"com.docker.network.gateway": "0.0.0.0/0"},
 	}
 
-	logutils.JSONMessage("RequestPool response", resp)
+	log.JSONMessage("RequestPool response", resp)
 
 	return resp, nil
 }
 
-func (i IpamDriver) ReleasePool(request *ipam.ReleasePoolRequest) error {
-	logutils.JSONMessage("ReleasePool", request)
+func (i IpamDriver) ReleasePool(request *ipam.ReleasePoolRequest) (err error) {
+	ctx, span := startRequest("ipam.ReleasePool", request.PoolID)
+	defer func() { span.Finish(err) }()
+	log := ipamLog.WithContext(ctx)
+	log.JSONMessage("ReleasePool", request)
 	return nil
 }
 
-func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
-	logutils.JSONMessage("RequestAddress", request)
+func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (_ *ipam.RequestAddressResponse, err error) {
+	config := i.settings.Load()
+	ctx, span := startRequest("ipam.RequestAddress", request.Address)
+	defer func() { span.Finish(err) }()
+	ctx = audit.WithRequest(ctx, "RequestAddress", "", "")
+	log := ipamLog.WithContext(ctx)
+	log.JSONMessage("RequestAddress", request)
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
 
-	hostname, err := osutils.GetHostname()
-	if err != nil {
-		log.Errorln(err)
-		return nil, err
-	}
+	hostname := config.NodeName
 
 	var IPs []caliconet.IP
 
 	if request.Address == "" {
 		// No address requested, so auto assign from our pools.
 		log.Println("Auto assigning IP from Calico pools")
+		i.autoAssigning.RLock()
+		defer i.autoAssigning.RUnlock()
 
 		// If the poolID isn't the fixed one then find the pool to assign from.
 		// poolV4 defaults to nil to assign from across all pools.
 		var poolV4 []caliconet.IPNet
 		if request.PoolID != PoolIDV4 {
-			poolsClient := i.client.IPPools()
 			_, ipNet, err := caliconet.ParseCIDR(request.PoolID)
 
 			if err != nil {
@@ -141,8 +191,11 @@ func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.R
 				log.Errorln(err)
 				return nil, err
 			}
-			pool, err := poolsClient.Get(api.IPPoolMetadata{CIDR: *ipNet})
-			if err != nil {
+			pool, err := i.client.GetIPPool(ctx, api.IPPoolMetadata{CIDR: *ipNet})
+			if timeoututils.IsTimeout(err) {
+				log.Errorln(err)
+				return nil, err
+			} else if err != nil {
 				err := errors.New("The network references a Calico pool which " +
 					"has been deleted. Please re-instate the " +
 					"Calico pool before using the network.")
@@ -156,7 +209,7 @@ func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.R
 		// Auto assign an IP address.
 		// IPv4 pool will be nil if the docker network doesn't have a subnet associated with.
 		// Otherwise, it will be set to the Calico pool to assign from.
-		IPsV4, IPsV6, err := i.client.IPAM().AutoAssign(
+		IPsV4, IPsV6, err := i.client.AutoAssign(ctx,
 			datastoreClient.AutoAssignArgs{
 				Num4:      1,
 				Num6:      0,
@@ -176,12 +229,13 @@ func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.R
 		// We'll return an error if the address isn't in a Calico pool, but we don't care which pool it's in
 		// (i.e. it doesn't need to match the subnet from the docker network).
 		log.Debugln("Reserving a specific address in Calico pools")
+		defer i.locks.Lock(request.Address)()
 		ip := net.ParseIP(request.Address)
 		ipArgs := datastoreClient.AssignIPArgs{
 			IP:       caliconet.IP{IP: ip},
 			Hostname: hostname,
 		}
-		err := i.client.IPAM().AssignIP(ipArgs)
+		err := i.client.AssignIP(ctx, ipArgs)
 		if err != nil {
 			err = errors.Wrapf(err, "IP assignment error, data: %+v", ipArgs)
 			log.Errorln(err)
@@ -198,28 +252,50 @@ func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.R
 		return nil, err
 	}
 
+	// The address is in use again, so a queued release of it must not go
+	// ahead.  Releases are retried under the address's lock, which is already
+	// held if a specific address was requested.
+	if request.Address == "" {
+		defer i.locks.Lock(IPs[0].String())()
+	}
+	i.retries.Remove(retryReleaseAddress, IPs[0].String())
+
 	// Return the IP as a CIDR.
 	resp := &ipam.RequestAddressResponse{
 		Address: fmt.Sprintf("%v/%v", IPs[0], "32"),
 	}
 
-	logutils.JSONMessage("RequestAddress response", resp)
+	log.JSONMessage("RequestAddress response", resp)
 
 	return resp, nil
 }
 
-func (i IpamDriver) ReleaseAddress(request *ipam.ReleaseAddressRequest) error {
-	logutils.JSONMessage("ReleaseAddress", request)
+func (i IpamDriver) ReleaseAddress(request *ipam.ReleaseAddressRequest) (err error) {
+	config := i.settings.Load()
+	ctx, span := startRequest("ipam.ReleaseAddress", request.Address)
+	defer func() { span.Finish(err) }()
+	ctx = audit.WithRequest(ctx, "ReleaseAddress", "", "")
+	log := ipamLog.WithContext(ctx)
+	log.JSONMessage("ReleaseAddress", request)
+	defer i.locks.Lock(request.Address)()
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
 
 	ip := caliconet.IP{IP: net.ParseIP(request.Address)}
 
 	// Unassign the address.  This handles the address already being unassigned
 	// in which case it is a no-op.
-	_, err := i.client.IPAM().ReleaseIPs([]caliconet.IP{ip})
+	_, err = i.client.ReleaseIPs(ctx, []caliconet.IP{ip})
 	if err != nil {
 		err = errors.Wrapf(err, "IP releasing error, ip: %v", ip)
 		log.Errorln(err)
-		return err
+
+		// Docker won't ask again, so keep trying to release the address in the
+		// background rather than leaking it.
+		if queueErr := i.retries.Add(retryReleaseAddress, ip.String(), nil, err); queueErr != nil {
+			log.Errorln(queueErr)
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,59 @@
+package driver
+
+import "sync"
+
+// networkInfo holds the details of a Docker network that the driver needs when
+// creating endpoints.
+type networkInfo struct {
+	Name    string
+	Labels  map[string]string
+	Options map[string]string
+}
+
+// networkCache maps Docker network IDs to their details so that the Docker API
+// only needs to be queried the first time an endpoint is created on a network.
+// Entries are dropped when Docker reports that the network has been removed.
+type networkCache struct {
+	mutex    sync.RWMutex
+	networks map[string]networkInfo
+}
+
+func newNetworkCache() *networkCache {
+	return &networkCache{networks: map[string]networkInfo{}}
+}
+
+func (c *networkCache) get(networkID string) (networkInfo, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	info, ok := c.networks[networkID]
+	return info, ok
+}
+
+func (c *networkCache) set(networkID string, info networkInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.networks[networkID] = info
+}
+
+func (c *networkCache) invalidate(networkID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.networks, networkID)
+}
+
+func (c *networkCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.networks = map[string]networkInfo{}
+}
+
+// snapshot returns a copy of the cached networks, for debugging.
+func (c *networkCache) snapshot() map[string]networkInfo {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	networks := make(map[string]networkInfo, len(c.networks))
+	for id, info := range c.networks {
+		networks[id] = info
+	}
+	return networks
+}
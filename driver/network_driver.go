@@ -4,62 +4,86 @@ import (
 	"context"
 	"net"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
 
 	dockerClient "github.com/docker/docker/client"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/projectcalico/libcalico-go/lib/api"
-	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
 	caliconet "github.com/projectcalico/libcalico-go/lib/net"
 
-	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	debugutils "github.com/projectcalico/libnetwork-plugin/utils/debug"
+	eventsutils "github.com/projectcalico/libnetwork-plugin/utils/events"
+	"github.com/projectcalico/libnetwork-plugin/utils/keylock"
 	mathutils "github.com/projectcalico/libnetwork-plugin/utils/math"
 	"github.com/projectcalico/libnetwork-plugin/utils/netns"
-	osutils "github.com/projectcalico/libnetwork-plugin/utils/os"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
 )
 
 // NetworkDriver is the Calico network driver representation.
-// Must be used with Calico IPAM and supports IPv4 only.
+// Must be used with Calico IPAM, unless AllowOtherIPAM is set, and supports
+// IPv4 only.
 type NetworkDriver struct {
-	client         *datastoreClient.Client
-	containerName  string
-	orchestratorID string
-	fixedMac       string
-
-	ifPrefix string
-
-	DummyIPV4Nexthop string
+	client    *datastore.Client
+	dockerCli *dockerClient.Client
+	networks  *networkCache
+	recent    *recentEndpoints
+	sweeps    chan struct{}
+	locks     *keylock.Locker
+	retries   *retryutils.Queue
+	settings  *Settings
 }
 
-func NewNetworkDriver(client *datastoreClient.Client) network.Driver {
-	return NetworkDriver{
-		client: client,
-
-		// The MAC address of the interface in the container is arbitrary, so for
-		// simplicity, use a fixed MAC.
-		fixedMac: "EE:EE:EE:EE:EE:EE",
-
-		// Orchestrator and container IDs used in our endpoint identification. These
-		// are fixed for libnetwork.  Unique endpoint identification is provided by
-		// hostname and endpoint ID.
-		containerName:  "libnetwork",
-		orchestratorID: "libnetwork",
-
-		ifPrefix:         IFPrefix,
-		DummyIPV4Nexthop: "169.254.1.1",
+// NewNetworkDriver creates the network driver, registering its handlers for
+// Docker container and network events with the watcher and its cleanup
+// operations with the retry queue.  Orphaned endpoints are only swept while
+// RunOrphanSweeps is running.
+func NewNetworkDriver(client *datastore.Client, dockerCli *dockerClient.Client, watcher *eventsutils.Watcher, retries *retryutils.Queue, settings *Settings) network.Driver {
+	d := NetworkDriver{
+		client:    client,
+		dockerCli: dockerCli,
+
+		// Network names are looked up once per network and cached, with the
+		// DockerFallback setting deciding what to do if Docker can't be
+		// reached.
+		networks: newNetworkCache(),
+
+		recent: newRecentEndpoints(),
+		sweeps: make(chan struct{}, 1),
+
+		// Docker can issue calls for the same endpoint concurrently, so they
+		// are serialized on the endpoint ID.
+		locks:   keylock.New(),
+		retries: retries,
+
+		settings: settings,
 	}
+	d.registerEventHandlers(watcher)
+	retries.Register(retryDeleteEndpoint, d.retryDeleteEndpoint)
+	debugutils.RegisterState("networkCache", func() interface{} { return d.networks.snapshot() })
+	debugutils.RegisterState("networkLocks", func() interface{} { return d.locks.Held() })
+	return d
 }
 
-func (d NetworkDriver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+func (d NetworkDriver) GetCapabilities() (_ *network.CapabilitiesResponse, err error) {
+	ctx, span := startRequest("network.GetCapabilities", "")
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
 	resp := network.CapabilitiesResponse{Scope: "global"}
-	logutils.JSONMessage("GetCapabilities response", resp)
+	log.JSONMessage("GetCapabilities response", resp)
 	return &resp, nil
 }
 
-func (d NetworkDriver) CreateNetwork(request *network.CreateNetworkRequest) error {
-	logutils.JSONMessage("CreateNetwork", request)
+func (d NetworkDriver) CreateNetwork(request *network.CreateNetworkRequest) (err error) {
+	config := d.settings.Load()
+	ctx, span := startRequest("network.CreateNetwork", request.NetworkID)
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("CreateNetwork", request)
 
 	genericOpts, ok := request.Options["com.docker.network.generic"]
 	if ok {
@@ -76,31 +100,37 @@ func (d NetworkDriver) CreateNetwork(request *network.CreateNetworkRequest) erro
 		// so we can't check for calico IPAM using our known address space.
 		// Also the pool might not have a fixed values if --subnet was passed
 		// So the only safe thing is to check for our special gateway value
-		if ipData.Gateway != "0.0.0.0/0" {
+		if ipData.Gateway != "0.0.0.0/0" && !config.AllowOtherIPAM {
 			err := errors.New("Non-Calico IPAM driver is used")
 			log.Errorln(err)
 			return err
 		}
 	}
 
-	logutils.JSONMessage("CreateNetwork response", map[string]string{})
+	log.JSONMessage("CreateNetwork response", map[string]string{})
 	return nil
 }
 
-func (d NetworkDriver) DeleteNetwork(request *network.DeleteNetworkRequest) error {
-	logutils.JSONMessage("DeleteNetwork", request)
+func (d NetworkDriver) DeleteNetwork(request *network.DeleteNetworkRequest) (err error) {
+	ctx, span := startRequest("network.DeleteNetwork", request.NetworkID)
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("DeleteNetwork", request)
 	return nil
 }
 
-func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	logutils.JSONMessage("CreateEndpoint", request)
+func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (_ *network.CreateEndpointResponse, err error) {
+	config := d.settings.Load()
+	ctx, span := startRequest("network.CreateEndpoint", request.EndpointID)
+	defer func() { span.Finish(err) }()
+	ctx = audit.WithRequest(ctx, "CreateEndpoint", request.EndpointID, request.NetworkID)
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("CreateEndpoint", request)
+	defer d.locks.Lock(request.EndpointID)()
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
 
-	hostname, err := osutils.GetHostname()
-	if err != nil {
-		err = errors.Wrap(err, "Hostname fetching error")
-		log.Errorln(err)
-		return nil, err
-	}
+	hostname := config.NodeName
 
 	log.Debugf("Creating endpoint %v\n", request.EndpointID)
 	if request.Interface.Address == "" {
@@ -126,25 +156,18 @@ func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (*
 
 	endpoint := api.NewWorkloadEndpoint()
 	endpoint.Metadata.Node = hostname
-	endpoint.Metadata.Orchestrator = d.orchestratorID
-	endpoint.Metadata.Workload = d.containerName
+	endpoint.Metadata.Orchestrator = config.OrchestratorID
+	endpoint.Metadata.Workload = config.WorkloadID
 	endpoint.Metadata.Name = request.EndpointID
+	endpoint.Metadata.Labels = map[string]string{networkIDLabel: shortNetworkID(request.NetworkID)}
 	endpoint.Spec.InterfaceName = "cali" + request.EndpointID[:mathutils.MinInt(11, len(request.EndpointID))]
-	mac, _ := net.ParseMAC(d.fixedMac)
+	mac, _ := net.ParseMAC(config.MACAddress)
 	endpoint.Spec.MAC = &caliconet.MAC{HardwareAddr: mac}
 	endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, addresses...)
 
 	// Use the Docker API to fetch the network name (so we don't have to use an ID everywhere)
-	dockerCli, err := dockerClient.NewEnvClient()
-	if err != nil {
-		err = errors.Wrap(err, "Error while attempting to instantiate docker client from env")
-		log.Errorln(err)
-		return nil, err
-	}
-	defer dockerCli.Close()
-	networkData, err := dockerCli.NetworkInspect(context.Background(), request.NetworkID)
+	networkData, err := d.lookupNetwork(ctx, request.NetworkID)
 	if err != nil {
-		err = errors.Wrapf(err, "Network %v inspection error", request.NetworkID)
 		log.Errorln(err)
 		return nil, err
 	}
@@ -155,17 +178,8 @@ func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (*
 	// If a profile for the network name doesn't exist then it needs to be created.
 	// We always attempt to create the profile and rely on the datastore to reject
 	// the request if the profile already exists.
-	profile := &api.Profile{
-		Metadata: api.ProfileMetadata{
-			Name: networkData.Name,
-			Tags: []string{networkData.Name},
-		},
-		Spec: api.ProfileSpec{
-			EgressRules:  []api.Rule{{Action: "allow"}},
-			IngressRules: []api.Rule{{Action: "allow", Source: api.EntityRule{Tag: networkData.Name}}},
-		},
-	}
-	if _, err := d.client.Profiles().Create(profile); err != nil {
+	profile := newProfile(config, networkData.Name)
+	if err := d.client.CreateProfile(ctx, profile); err != nil {
 		if _, ok := err.(libcalicoErrors.ErrorResourceAlreadyExists); !ok {
 			log.Errorln(err)
 			return nil, err
@@ -173,7 +187,10 @@ func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (*
 	}
 
 	// Create the endpoint last to minimize side-effects if something goes wrong.
-	_, err = d.client.WorkloadEndpoints().Create(endpoint)
+	// It's recorded first so the orphaned endpoint cleanup won't race with Docker
+	// attaching it to the container.
+	d.recent.add(request.EndpointID)
+	err = d.client.CreateWorkloadEndpoint(ctx, endpoint)
 	if err != nil {
 		err = errors.Wrapf(err, "Workload endpoints creation error, data: %+v", endpoint)
 		log.Errorln(err)
@@ -184,59 +201,162 @@ func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (*
 
 	response := &network.CreateEndpointResponse{
 		Interface: &network.EndpointInterface{
-			MacAddress: string(d.fixedMac),
+			MacAddress: config.MACAddress,
 		},
 	}
 
-	logutils.JSONMessage("CreateEndpoint response", response)
+	log.JSONMessage("CreateEndpoint response", response)
 
 	return response, nil
 }
 
-func (d NetworkDriver) DeleteEndpoint(request *network.DeleteEndpointRequest) error {
-	logutils.JSONMessage("DeleteEndpoint", request)
-	log.Debugf("Removing endpoint %v\n", request.EndpointID)
+// newProfile returns the profile for a new network with the given name, allowing
+// the traffic the settings ask for.
+func newProfile(config Config, name string) *api.Profile {
+	profile := &api.Profile{
+		Metadata: api.ProfileMetadata{
+			Name: name,
+			Tags: []string{name},
+		},
+	}
+	switch config.ProfileIngress {
+	case ProfileIngressNetwork:
+		profile.Spec.IngressRules = []api.Rule{{Action: "allow", Source: api.EntityRule{Tag: name}}}
+	case ProfileAll:
+		profile.Spec.IngressRules = []api.Rule{{Action: "allow"}}
+	}
+	if config.ProfileEgress == ProfileAll {
+		profile.Spec.EgressRules = []api.Rule{{Action: "allow"}}
+	}
+	return profile
+}
 
-	hostname, err := osutils.GetHostname()
+// lookupNetwork returns the details of a Docker network, only querying the
+// Docker API if they aren't already cached.
+func (d NetworkDriver) lookupNetwork(ctx context.Context, networkID string) (networkInfo, error) {
+	if info, ok := d.networks.get(networkID); ok {
+		return info, nil
+	}
+
+	_, span := traceutils.StartSpan(ctx, "Docker network inspection", traceutils.KindClient)
+	span.SetAttribute("network.id", networkID)
+	networkData, err := d.dockerCli.NetworkInspect(ctx, networkID)
+	err = timeoututils.Check(ctx, "Docker network inspection", err)
+	span.Finish(err)
 	if err != nil {
-		err = errors.Wrap(err, "Hostname fetching error")
-		log.Errorln(err)
-		return err
+		if !dockerClient.IsErrNetworkNotFound(err) && d.settings.Load().DockerFallback == DockerFallbackNetworkID {
+			info, fallbackErr := d.lookupNetworkFromEndpoints(ctx, networkID)
+			if fallbackErr != nil {
+				return networkInfo{}, errors.Wrapf(fallbackErr, "Network %v inspection error: %v", networkID, err)
+			}
+			networkLog.WithContext(ctx).Warnf("Network %v inspection error, using the profile %v of its other endpoints: %v", networkID, info.Name, err)
+			return info, nil
+		}
+		return networkInfo{}, errors.Wrapf(err, "Network %v inspection error", networkID)
 	}
 
-	if err = d.client.WorkloadEndpoints().Delete(
-		api.WorkloadEndpointMetadata{
-			Name:         request.EndpointID,
-			Node:         hostname,
-			Orchestrator: d.orchestratorID,
-			Workload:     d.containerName}); err != nil {
+	info := networkInfo{
+		Name:    networkData.Name,
+		Labels:  networkData.Labels,
+		Options: networkData.Options,
+	}
+	d.networks.set(networkID, info)
+	return info, nil
+}
+
+// lookupNetworkFromEndpoints finds the name of a Docker network from the profile
+// of another endpoint that was created on it, for when the Docker API can't be
+// used.  Using anything else, such as the network ID, would put the endpoint in
+// a profile of its own that can't reach the rest of the network.  Only the name
+// is known, so the result isn't cached.
+func (d NetworkDriver) lookupNetworkFromEndpoints(ctx context.Context, networkID string) (networkInfo, error) {
+	config := d.settings.Load()
+	endpoints, err := d.client.ListWorkloadEndpoints(ctx, api.WorkloadEndpointMetadata{
+		Orchestrator: config.OrchestratorID,
+		Workload:     config.WorkloadID})
+	if err != nil {
+		return networkInfo{}, errors.Wrap(err, "Workload endpoints listing error")
+	}
+
+	shortID := shortNetworkID(networkID)
+	for _, endpoint := range endpoints.Items {
+		if endpoint.Metadata.Labels[networkIDLabel] == shortID && len(endpoint.Spec.Profiles) > 0 {
+			return networkInfo{Name: endpoint.Spec.Profiles[0]}, nil
+		}
+	}
+	return networkInfo{}, errors.Errorf("No other endpoints on network %v to take its profile from", networkID)
+}
+
+// shortNetworkID returns the abbreviated form of a Docker network ID that Docker
+// itself displays.
+func shortNetworkID(networkID string) string {
+	return networkID[:mathutils.MinInt(12, len(networkID))]
+}
+
+func (d NetworkDriver) DeleteEndpoint(request *network.DeleteEndpointRequest) (err error) {
+	config := d.settings.Load()
+	ctx, span := startRequest("network.DeleteEndpoint", request.EndpointID)
+	defer func() { span.Finish(err) }()
+	ctx = audit.WithRequest(ctx, "DeleteEndpoint", request.EndpointID, request.NetworkID)
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("DeleteEndpoint", request)
+	defer d.locks.Lock(request.EndpointID)()
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
+	log.Debugf("Removing endpoint %v\n", request.EndpointID)
+
+	hostname := config.NodeName
+
+	metadata := api.WorkloadEndpointMetadata{
+		Name:         request.EndpointID,
+		Node:         hostname,
+		Orchestrator: config.OrchestratorID,
+		Workload:     config.WorkloadID}
+	if err = d.client.DeleteWorkloadEndpoint(ctx, metadata); err != nil {
 		err = errors.Wrapf(err, "Endpoint %v removal error", request.EndpointID)
 		log.Errorln(err)
-		return err
+		if _, ok := errors.Cause(err).(libcalicoErrors.ErrorResourceDoesNotExist); ok {
+			return err
+		}
+
+		// Docker won't ask again, so keep trying to remove the endpoint in the
+		// background rather than leaking it.
+		if queueErr := d.retries.Add(retryDeleteEndpoint, request.EndpointID, endpointRetryArgs(metadata), err); queueErr != nil {
+			log.Errorln(queueErr)
+			return err
+		}
+		err = nil
 	}
 
-	logutils.JSONMessage("DeleteEndpoint response JSON=%v", map[string]string{})
+	log.JSONMessage("DeleteEndpoint response JSON=%v", map[string]string{})
 
 	return err
 }
 
-func (d NetworkDriver) EndpointInfo(request *network.InfoRequest) (*network.InfoResponse, error) {
-	logutils.JSONMessage("EndpointInfo", request)
+func (d NetworkDriver) EndpointInfo(request *network.InfoRequest) (_ *network.InfoResponse, err error) {
+	ctx, span := startRequest("network.EndpointInfo", request.EndpointID)
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("EndpointInfo", request)
 	return nil, nil
 }
 
-func (d NetworkDriver) Join(request *network.JoinRequest) (*network.JoinResponse, error) {
-	logutils.JSONMessage("Join", request)
+func (d NetworkDriver) Join(request *network.JoinRequest) (_ *network.JoinResponse, err error) {
+	config := d.settings.Load()
+	ctx, span := startRequest("network.Join", request.EndpointID)
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("Join", request)
+	defer d.locks.Lock(request.EndpointID)()
 
 	// 1) Set up a veth pair
 	// 	The one end will stay in the host network namespace - named caliXXXXX
 	//	The other end is given a temporary name. It's moved into the final network namespace by libnetwork itself.
-	var err error
 	prefix := request.EndpointID[:mathutils.MinInt(11, len(request.EndpointID))]
 	hostInterfaceName := "cali" + prefix
 	tempInterfaceName := "temp" + prefix
 
-	if err = netns.CreateVeth(hostInterfaceName, tempInterfaceName); err != nil {
+	if err = netns.CreateVeth(ctx, hostInterfaceName, tempInterfaceName); err != nil {
 		err = errors.Wrapf(
 			err, "Veth creation error, hostInterfaceName=%v, tempInterfaceName=%v",
 			hostInterfaceName, tempInterfaceName)
@@ -245,9 +365,9 @@ func (d NetworkDriver) Join(request *network.JoinRequest) (*network.JoinResponse
 	}
 
 	// libnetwork doesn't set the MAC address properly, so set it here.
-	if err = netns.SetVethMac(tempInterfaceName, d.fixedMac); err != nil {
+	if err = netns.SetVethMac(ctx, tempInterfaceName, config.MACAddress); err != nil {
 		log.Debugf("Veth mac setting for %v failed, removing veth for %v\n", tempInterfaceName, hostInterfaceName)
-		err = netns.RemoveVeth(hostInterfaceName)
+		err = netns.RemoveVeth(ctx, hostInterfaceName)
 		err = errors.Wrapf(err, "Veth removing for %v error", hostInterfaceName)
 		log.Errorln(err)
 		return nil, err
@@ -256,7 +376,7 @@ func (d NetworkDriver) Join(request *network.JoinRequest) (*network.JoinResponse
 	resp := &network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   tempInterfaceName,
-			DstPrefix: IFPrefix,
+			DstPrefix: config.InterfacePrefix,
 		},
 	}
 
@@ -265,33 +385,42 @@ func (d NetworkDriver) Join(request *network.JoinRequest) (*network.JoinResponse
 	// configured on the endpoint (which will be our host IPs).
 	log.Debugln("Using Calico IPAM driver, configure gateway and static routes to the host")
 
-	resp.Gateway = d.DummyIPV4Nexthop
+	resp.Gateway = config.GatewayIPv4
 	resp.StaticRoutes = append(resp.StaticRoutes, &network.StaticRoute{
-		Destination: d.DummyIPV4Nexthop + "/32",
+		Destination: config.GatewayIPv4 + "/32",
 		RouteType:   1, // 1 = CONNECTED
 		NextHop:     "",
 	})
 
-	logutils.JSONMessage("Join response", resp)
+	log.JSONMessage("Join response", resp)
 
 	return resp, nil
 }
 
-func (d NetworkDriver) Leave(request *network.LeaveRequest) error {
-	logutils.JSONMessage("Leave response", request)
+func (d NetworkDriver) Leave(request *network.LeaveRequest) (err error) {
+	ctx, span := startRequest("network.Leave", request.EndpointID)
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("Leave response", request)
+	defer d.locks.Lock(request.EndpointID)()
 	caliName := "cali" + request.EndpointID[:mathutils.MinInt(11, len(request.EndpointID))]
-	err := netns.RemoveVeth(caliName)
-	return err
+	return netns.RemoveVeth(ctx, caliName)
 }
 
-func (d NetworkDriver) DiscoverNew(request *network.DiscoveryNotification) error {
-	logutils.JSONMessage("DiscoverNew", request)
+func (d NetworkDriver) DiscoverNew(request *network.DiscoveryNotification) (err error) {
+	ctx, span := startRequest("network.DiscoverNew", "")
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("DiscoverNew", request)
 	log.Debugln("DiscoverNew response JSON={}")
 	return nil
 }
 
-func (d NetworkDriver) DiscoverDelete(request *network.DiscoveryNotification) error {
-	logutils.JSONMessage("DiscoverNew", request)
+func (d NetworkDriver) DiscoverDelete(request *network.DiscoveryNotification) (err error) {
+	ctx, span := startRequest("network.DiscoverDelete", "")
+	defer func() { span.Finish(err) }()
+	log := networkLog.WithContext(ctx)
+	log.JSONMessage("DiscoverNew", request)
 	log.Debugln("DiscoverDelete response JSON={}")
 	return nil
 }
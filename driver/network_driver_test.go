@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/go-plugins-helpers/network"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	eventsutils "github.com/projectcalico/libnetwork-plugin/utils/events"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+)
+
+var _ = Describe("Network creation", func() {
+	var retryDir string
+	var settings *Settings
+	var d NetworkDriver
+
+	BeforeEach(func() {
+		var err error
+		retryDir, err = ioutil.TempDir("", "retries")
+		Expect(err).NotTo(HaveOccurred())
+		retries, err := retryutils.Open(filepath.Join(retryDir, "queue.json"))
+		Expect(err).NotTo(HaveOccurred())
+		settings = NewSettings(DefaultConfig())
+		d = NewNetworkDriver(datastore.NewClient(newFakeCalico(), nil), nil, eventsutils.NewWatcher(nil), retries, settings).(NetworkDriver)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(retryDir)).To(Succeed())
+	})
+
+	request := func(gateway string) *network.CreateNetworkRequest {
+		return &network.CreateNetworkRequest{
+			NetworkID: "network",
+			IPv4Data:  []*network.IPAMData{{Pool: "10.0.0.0/24", Gateway: gateway}},
+		}
+	}
+
+	It("only accepts Calico IPAM by default", func() {
+		Expect(d.CreateNetwork(request("0.0.0.0/0"))).To(Succeed())
+		Expect(d.CreateNetwork(request("10.0.0.1/24"))).To(MatchError("Non-Calico IPAM driver is used"))
+	})
+
+	It("accepts other IPAM drivers when allowed", func() {
+		config := DefaultConfig()
+		config.AllowOtherIPAM = true
+		settings.Store(config)
+		Expect(d.CreateNetwork(request("10.0.0.1/24"))).To(Succeed())
+	})
+})
+
+var _ = Describe("Endpoint removal retries", func() {
+	var retryDir string
+	var settings *Settings
+	var fake *fakeCalico
+	var d NetworkDriver
+
+	BeforeEach(func() {
+		var err error
+		retryDir, err = ioutil.TempDir("", "retries")
+		Expect(err).NotTo(HaveOccurred())
+		retries, err := retryutils.Open(filepath.Join(retryDir, "queue.json"))
+		Expect(err).NotTo(HaveOccurred())
+		settings = NewSettings(DefaultConfig())
+		fake = newFakeCalico()
+		d = NewNetworkDriver(datastore.NewClient(fake, nil), nil, eventsutils.NewWatcher(nil), retries, settings).(NetworkDriver)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(retryDir)).To(Succeed())
+	})
+
+	It("removes the endpoint that was queued after the IDs change", func() {
+		config := DefaultConfig()
+		metadata := api.WorkloadEndpointMetadata{
+			Name:         "ep1",
+			Node:         "host",
+			Orchestrator: config.OrchestratorID,
+			Workload:     config.WorkloadID}
+		fake.endpoints["ep1"] = api.WorkloadEndpoint{Metadata: metadata}
+
+		config.OrchestratorID = "other"
+		config.WorkloadID = "other"
+		settings.Store(config)
+
+		Expect(d.retries.Add(retryDeleteEndpoint, "ep1", endpointRetryArgs(metadata), errors.New("etcd unavailable"))).To(Succeed())
+		Expect(d.retryDeleteEndpoint(d.retries.Operations()[0])).To(Succeed())
+		Expect(fake.endpoints).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Network lookups without the Docker API", func() {
+	var retryDir string
+	var d NetworkDriver
+
+	BeforeEach(func() {
+		var err error
+		retryDir, err = ioutil.TempDir("", "retries")
+		Expect(err).NotTo(HaveOccurred())
+		retries, err := retryutils.Open(filepath.Join(retryDir, "queue.json"))
+		Expect(err).NotTo(HaveOccurred())
+		d = NewNetworkDriver(datastore.NewClient(newFakeCalico(), nil), nil, eventsutils.NewWatcher(nil), retries, NewSettings(DefaultConfig())).(NetworkDriver)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(retryDir)).To(Succeed())
+	})
+
+	createEndpoint := func(networkID, endpointID string) {
+		_, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  networkID,
+			EndpointID: endpointID,
+			Interface:  &network.EndpointInterface{Address: "192.168.0.1/32"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("uses the profile of another endpoint on the network", func() {
+		d.networks.set("0123456789abcdef", networkInfo{Name: "frontend"})
+		d.networks.set("fedcba9876543210", networkInfo{Name: "backend"})
+		createEndpoint("0123456789abcdef", "ep1")
+		createEndpoint("fedcba9876543210", "ep2")
+
+		info, err := d.lookupNetworkFromEndpoints(context.Background(), "0123456789abcdef")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Name).To(Equal("frontend"))
+	})
+
+	It("fails if there are no other endpoints on the network", func() {
+		d.networks.set("0123456789abcdef", networkInfo{Name: "frontend"})
+		createEndpoint("0123456789abcdef", "ep1")
+
+		_, err := d.lookupNetworkFromEndpoints(context.Background(), "fedcba9876543210")
+		Expect(err).To(MatchError("No other endpoints on network fedcba9876543210 to take its profile from"))
+	})
+})
+
+var _ = Describe("Network profiles", func() {
+	It("allows traffic from the same network and to anywhere by default", func() {
+		profile := newProfile(DefaultConfig(), "frontend")
+		Expect(profile.Spec.IngressRules).To(Equal([]api.Rule{{Action: "allow", Source: api.EntityRule{Tag: "frontend"}}}))
+		Expect(profile.Spec.EgressRules).To(Equal([]api.Rule{{Action: "allow"}}))
+	})
+
+	It("allows the traffic that the settings ask for", func() {
+		config := DefaultConfig()
+		config.ProfileIngress = ProfileAll
+		config.ProfileEgress = ProfileNone
+		profile := newProfile(config, "frontend")
+		Expect(profile.Spec.IngressRules).To(Equal([]api.Rule{{Action: "allow"}}))
+		Expect(profile.Spec.EgressRules).To(BeEmpty())
+
+		config.ProfileIngress = ProfileNone
+		Expect(newProfile(config, "frontend").Spec.IngressRules).To(BeEmpty())
+	})
+})
@@ -1,6 +1,11 @@
 package driver
 
-import "os"
+import (
+	"context"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
+)
 
 const (
 	// Calico IPAM module does not allow selection of pools from which to allocate
@@ -11,12 +16,37 @@ const (
 	PoolIDV6 = "CalicoPoolIPv6"
 
 	CalicoGlobalAddressSpace = "CalicoGlobalAddressSpace"
+
+	// Behaviours when the Docker API can't be used to look up a network name.
+	// DockerFallbackError fails the request, DockerFallbackNetworkID carries on
+	// using the profile of another endpoint on the same network.
+	DockerFallbackError     = "error"
+	DockerFallbackNetworkID = "network-id"
+
+	// The traffic allowed by the profiles of new networks.  Ingress from
+	// ProfileIngressNetwork is only allowed from endpoints on the same network.
+	ProfileIngressNetwork = "network"
+	ProfileAll            = "all"
+	ProfileNone           = "none"
+
+	// Endpoints are labelled with the short ID of their Docker network, so that
+	// the network's profile can be found without the Docker API.  Full network
+	// IDs are longer than a label value may be.
+	networkIDLabel = "org.projectcalico.libnetwork.network"
 )
 
-var IFPrefix = "cali"
+// Loggers for the network and IPAM drivers, whose levels can be set separately.
+var (
+	networkLog = logutils.Network
+	ipamLog    = logutils.IPAM
+)
 
-func init() {
-	if os.Getenv("CALICO_LIBNETWORK_IFPREFIX") != "" {
-		IFPrefix = os.Getenv("CALICO_LIBNETWORK_IFPREFIX")
-	}
+// startRequest returns the context for handling a libnetwork request, which
+// carries the request's correlation ID and its tracing span.  The caller must
+// finish the span.
+func startRequest(method, correlationID string) (context.Context, *traceutils.Span) {
+	ctx := logutils.WithCorrelationID(context.Background(), correlationID)
+	ctx, span := traceutils.StartSpan(ctx, method, traceutils.KindServer)
+	span.SetAttribute(logutils.CorrelationIDField, logutils.CorrelationID(ctx))
+	return ctx, span
 }
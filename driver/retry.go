@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"context"
+	"net"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+)
+
+// Kinds of cleanup operation that are retried in the background if they fail,
+// so that datastore objects aren't leaked once Docker has forgotten about them.
+const (
+	retryDeleteEndpoint = "DeleteEndpoint"
+	retryReleaseAddress = "ReleaseAddress"
+)
+
+// endpointRetryArgs records the whole key of an endpoint whose removal is
+// retried, so that the retry still finds it if the orchestrator or workload ID
+// is changed in the meantime.
+func endpointRetryArgs(metadata api.WorkloadEndpointMetadata) map[string]string {
+	return map[string]string{
+		"node":         metadata.Node,
+		"orchestrator": metadata.Orchestrator,
+		"workload":     metadata.Workload,
+	}
+}
+
+func (d NetworkDriver) retryDeleteEndpoint(op retryutils.Operation) error {
+	config := d.settings.Load()
+	defer d.locks.Lock(op.Key)()
+	if !d.retries.Queued(op) {
+		return nil
+	}
+	ctx := audit.WithRequest(logutils.WithCorrelationID(context.Background(), op.Key), "Retry"+op.Kind, op.Key, "")
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
+
+	metadata := api.WorkloadEndpointMetadata{
+		Name:         op.Key,
+		Node:         op.Args["node"],
+		Orchestrator: op.Args["orchestrator"],
+		Workload:     op.Args["workload"]}
+
+	// Operations queued before the IDs were recorded use the current ones.
+	if metadata.Orchestrator == "" {
+		metadata.Orchestrator = config.OrchestratorID
+	}
+	if metadata.Workload == "" {
+		metadata.Workload = config.WorkloadID
+	}
+
+	err := d.client.DeleteWorkloadEndpoint(ctx, metadata)
+	if _, ok := err.(libcalicoErrors.ErrorResourceDoesNotExist); ok {
+		return nil
+	}
+	return err
+}
+
+func (i IpamDriver) retryReleaseAddress(op retryutils.Operation) error {
+	config := i.settings.Load()
+	i.autoAssigning.Lock()
+	defer i.autoAssigning.Unlock()
+	defer i.locks.Lock(op.Key)()
+
+	// The address may have been assigned again while waiting, in which case
+	// the release has been dropped and mustn't go ahead.
+	if !i.retries.Queued(op) {
+		return nil
+	}
+	ctx := audit.WithRequest(logutils.WithCorrelationID(context.Background(), op.Key), "Retry"+op.Kind, "", "")
+	ctx, cancel := context.WithTimeout(ctx, config.RPCTimeout)
+	defer cancel()
+
+	_, err := i.client.ReleaseIPs(ctx, []caliconet.IP{{IP: net.ParseIP(op.Key)}})
+	return err
+}
@@ -0,0 +1,119 @@
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	dockerClient "github.com/docker/docker/client"
+	"github.com/projectcalico/libcalico-go/lib/api"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	osutils "github.com/projectcalico/libnetwork-plugin/utils/os"
+	timeoututils "github.com/projectcalico/libnetwork-plugin/utils/timeout"
+)
+
+// SocketCheck checks that something is accepting connections on the unix
+// socket at path.
+func SocketCheck(path string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "unix", path)
+		if err != nil {
+			return errors.Wrapf(err, "Socket %v connection error", path)
+		}
+		return conn.Close()
+	}
+}
+
+// TCPCheck checks that something is accepting connections on the TCP address.
+func TCPCheck(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "Address %v connection error", addr)
+		}
+		return conn.Close()
+	}
+}
+
+// DatastoreCheck checks that the datastore can be read.
+func DatastoreCheck(client *datastore.Client) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := client.ListIPPools(ctx, api.IPPoolMetadata{})
+		return errors.Wrap(err, "Datastore reading error")
+	}
+}
+
+// DockerCheck checks that the Docker API responds.
+func DockerCheck(dockerCli *dockerClient.Client) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := dockerCli.ServerVersion(ctx)
+		err = timeoututils.Check(ctx, "Docker version fetching", err)
+		return errors.Wrap(err, "Docker API error")
+	}
+}
+
+// NetlinkCheck checks that the network interfaces on this host can be listed.
+func NetlinkCheck() func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		err := timeoututils.Run(ctx, "netlink link listing", func() error {
+			_, err := netlink.LinkList()
+			return err
+		})
+		return errors.Wrap(err, "Netlink error")
+	}
+}
+
+// NetAdminCheck checks that the process described by statusFile has the
+// CAP_NET_ADMIN capability, which the network driver needs to create veths.
+func NetAdminCheck(statusFile string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		has, err := osutils.HasCapability(statusFile, osutils.CapNetAdmin)
+		if err != nil {
+			return errors.Wrap(err, "Capability checking error")
+		}
+		if !has {
+			return errors.New("The plugin doesn't have the CAP_NET_ADMIN capability, which it needs to create veths; run it with --cap-add NET_ADMIN or --privileged")
+		}
+		return nil
+	}
+}
+
+// WritableDirCheck checks that files can be created in dir, creating it if it
+// doesn't exist yet, as the plugin does when it creates its sockets there.
+func WritableDirCheck(dir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "Directory %v creation error", dir)
+		}
+		f, err := ioutil.TempFile(dir, ".preflight")
+		if err != nil {
+			return errors.Wrapf(err, "Directory %v isn't writable", dir)
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
+
+// IPPoolCheck checks that at least one IP pool is enabled, since no addresses
+// can be assigned to containers without one.
+func IPPoolCheck(client *datastore.Client) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		pools, err := client.ListIPPools(ctx, api.IPPoolMetadata{})
+		if err != nil {
+			return errors.Wrap(err, "IP pools listing error")
+		}
+		for _, pool := range pools.Items {
+			if !pool.Spec.Disabled {
+				return nil
+			}
+		}
+		return errors.New("No enabled IP pools are configured, so no addresses can be assigned; create one with calicoctl, or start calico/node to create the default pools")
+	}
+}
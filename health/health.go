@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Result is the outcome of a single check.  A warning's failure is reported
+// without failing the checks as a whole.
+type Result struct {
+	Name    string
+	Err     error
+	Warning bool
+}
+
+type check struct {
+	name     string
+	liveness bool
+	warning  bool
+	run      func(ctx context.Context) error
+}
+
+// Checker runs a set of checks on the plugin's dependencies.  Liveness checks
+// cover the plugin process itself and are run for both /healthz and /readyz;
+// the rest cover external dependencies and are only run for /readyz.
+type Checker struct {
+	timeout time.Duration
+	checks  []check
+}
+
+// NewChecker creates a checker that gives each check the given time to
+// complete.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check.  Checks must be added before the checker is used.
+func (c *Checker) Add(name string, liveness bool, run func(ctx context.Context) error) {
+	c.checks = append(c.checks, check{name: name, liveness: liveness, run: run})
+}
+
+// AddWarning registers a readiness check that is reported but never fails the
+// checks, for conditions that may be put right after the plugin starts.
+func (c *Checker) AddWarning(name string, run func(ctx context.Context) error) {
+	c.checks = append(c.checks, check{name: name, warning: true, run: run})
+}
+
+// Run runs the liveness checks, and the readiness checks too if readiness is
+// set, returning the result of each and whether they all passed.
+func (c *Checker) Run(readiness bool) ([]Result, bool) {
+	var results []Result
+	ok := true
+	for _, check := range c.checks {
+		if !check.liveness && !readiness {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := check.run(ctx)
+		cancel()
+		if err != nil && !check.warning {
+			ok = false
+		}
+		results = append(results, Result{Name: check.name, Err: err, Warning: check.warning})
+	}
+	return results, ok
+}
+
+// HealthzHandler serves the result of the liveness checks.
+func (c *Checker) HealthzHandler() http.Handler {
+	return c.handler(false)
+}
+
+// ReadyzHandler serves the result of all the checks.
+func (c *Checker) ReadyzHandler() http.Handler {
+	return c.handler(true)
+}
+
+// handler responds with 200 if the checks passed and 503 if not, listing the
+// result of each check in the body.
+func (c *Checker) handler(readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := c.Run(readiness)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				log.Warnf("Health check %v failed: %v", result.Name, result.Err)
+			}
+			fmt.Fprintln(w, result)
+		}
+	})
+}
+
+func (r Result) String() string {
+	if r.Err != nil && r.Warning {
+		return fmt.Sprintf("%v: warning: %v", r.Name, r.Err)
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("%v: failed: %v", r.Name, r.Err)
+	}
+	return fmt.Sprintf("%v: ok", r.Name)
+}
@@ -0,0 +1,18 @@
+package health
+
+import (
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Health Suite")
+}
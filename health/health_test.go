@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Health checker", func() {
+	var checker *Checker
+	var dependencyErr error
+
+	BeforeEach(func() {
+		dependencyErr = nil
+		checker = NewChecker(time.Second)
+		checker.Add("process", true, func(ctx context.Context) error { return nil })
+		checker.Add("dependency", false, func(ctx context.Context) error { return dependencyErr })
+	})
+
+	get := func(handler http.Handler) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	It("reports healthy and ready when all checks pass", func() {
+		Expect(get(checker.HealthzHandler()).Code).To(Equal(http.StatusOK))
+		w := get(checker.ReadyzHandler())
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(Equal("process: ok\ndependency: ok\n"))
+	})
+
+	It("only fails readiness when a dependency fails", func() {
+		dependencyErr = errors.New("unreachable")
+		Expect(get(checker.HealthzHandler()).Code).To(Equal(http.StatusOK))
+		w := get(checker.ReadyzHandler())
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(w.Body.String()).To(ContainSubstring("dependency: failed: unreachable"))
+	})
+
+	It("reports warnings without failing", func() {
+		checker.AddWarning("optional", func(ctx context.Context) error { return errors.New("missing") })
+		w := get(checker.ReadyzHandler())
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(ContainSubstring("optional: warning: missing"))
+
+		results, ok := checker.Run(false)
+		Expect(ok).To(BeTrue())
+		Expect(results).To(HaveLen(1))
+	})
+
+	It("gives each check a deadline", func() {
+		checker = NewChecker(10 * time.Millisecond)
+		checker.Add("slow", true, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		results, ok := checker.Run(false)
+		Expect(ok).To(BeFalse())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).To(Equal(context.DeadlineExceeded))
+	})
+
+	Describe("socket check", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "health")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("passes only while the socket is listening", func() {
+			path := filepath.Join(dir, "plugin.sock")
+			Expect(SocketCheck(path)(context.Background())).NotTo(Succeed())
+
+			l, err := net.Listen("unix", path)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+			Expect(SocketCheck(path)(context.Background())).To(Succeed())
+		})
+	})
+
+	Describe("writable directory check", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "health")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.Chmod(dir, 0700)).To(Succeed())
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("creates the directory and leaves nothing in it", func() {
+			plugins := filepath.Join(dir, "plugins")
+			Expect(WritableDirCheck(plugins)(context.Background())).To(Succeed())
+			files, err := ioutil.ReadDir(plugins)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("fails if the directory isn't writable", func() {
+			if os.Geteuid() == 0 {
+				Skip("root can write to any directory")
+			}
+			Expect(os.Chmod(dir, 0500)).To(Succeed())
+			Expect(WritableDirCheck(dir)(context.Background())).To(MatchError(ContainSubstring("isn't writable")))
+		})
+	})
+})
@@ -1,91 +1,625 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	dockerClient "github.com/docker/docker/client"
 	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/go-plugins-helpers/network"
+	"github.com/pkg/errors"
 	"github.com/projectcalico/libcalico-go/lib/api"
+	libcalicoErrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libnetwork-plugin/config"
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	"github.com/projectcalico/libnetwork-plugin/diags"
 	"github.com/projectcalico/libnetwork-plugin/driver"
+	"github.com/projectcalico/libnetwork-plugin/health"
+	"github.com/projectcalico/libnetwork-plugin/metrics"
+	"github.com/projectcalico/libnetwork-plugin/utils/audit"
+	debugutils "github.com/projectcalico/libnetwork-plugin/utils/debug"
+	eventsutils "github.com/projectcalico/libnetwork-plugin/utils/events"
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	managedutils "github.com/projectcalico/libnetwork-plugin/utils/managed"
+	osutils "github.com/projectcalico/libnetwork-plugin/utils/os"
+	retryutils "github.com/projectcalico/libnetwork-plugin/utils/retry"
+	slowcallutils "github.com/projectcalico/libnetwork-plugin/utils/slowcall"
+	socketutils "github.com/projectcalico/libnetwork-plugin/utils/socket"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
 
 	"flag"
 
 	"fmt"
-
-	datastoreClient "github.com/projectcalico/libcalico-go/lib/client"
 )
 
 const (
-	ipamPluginName    = "calico-ipam"
-	networkPluginName = "calico"
+	// Time allowed for each health check.
+	healthCheckTimeout = 5 * time.Second
+
+	// How many of the slowest recent calls are shown in the debug state.
+	slowestCallsShown = 20
 )
 
 var (
-	config *api.CalicoAPIConfig
-	client *datastoreClient.Client
+	datastoreConfig *api.CalicoAPIConfig
+	client          datastore.CalicoClient
+	dockerCli       *dockerClient.Client
+	retries         *retryutils.Queue
 )
 
-func init() {
-	// Output to stderr instead of stdout, could also be a file.
-	log.SetOutput(os.Stderr)
-}
-
-func initializeClient() {
+func initializeClient(cfg *config.Config) {
 	var err error
 
-	if config, err = datastoreClient.LoadClientConfig(""); err != nil {
+	if datastoreConfig, err = cfg.DatastoreConfig(); err != nil {
 		panic(err)
 	}
-	if client, err = datastoreClient.New(*config); err != nil {
+	if data, err := json.Marshal(config.RedactDatastore(datastoreConfig)); err == nil {
+		log.Infof("Datastore config: %s", data)
+	}
+	if client, err = cfg.CalicoClient(datastoreConfig); err != nil {
+		panic(err)
+	}
+	if datastoreConfig.Spec.DatastoreType == config.DatastoreLocal {
+		log.Warnln("The local datastore only records endpoints and assigns addresses; without Felix, containers have no connectivity")
+	}
+
+	// A single Docker client is shared for the lifetime of the plugin.
+	if dockerCli, err = dockerClient.NewEnvClient(); err != nil {
 		panic(err)
 	}
 
-	if os.Getenv("CALICO_DEBUG") != "" {
-		log.SetLevel(log.DebugLevel)
-		log.Debugln("Debug logging enabled")
+	// Failed cleanup operations are saved here and retried in the background.
+	if retries, err = retryutils.Open(cfg.RetryQueue); err != nil {
+		panic(err)
+	}
+}
+
+// handleSignals logs the stacks of all goroutines each time the plugin
+// receives SIGUSR1, toggles debug logging for every subsystem each time it
+// receives SIGUSR2 and reloads the config each time it receives SIGHUP.
+func handleSignals(reloader *config.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			if _, err := reloader.Reload(); err != nil {
+				log.Errorln(err)
+			}
+		case syscall.SIGUSR1:
+			log.Infof("Goroutine stacks:\n%s", debugutils.Stacks())
+		case syscall.SIGUSR2:
+			logutils.ToggleDebug()
+		}
+	}
+}
+
+// servedPlugin is a plugin that drivers are served as, on its socket or on a
+// TCP address if one is given.
+type servedPlugin struct {
+	name, tcpAddr string
+}
+
+// servedPlugins returns the plugins that the enabled drivers are served as.  A
+// managed plugin serves them on the one socket Docker gives it.
+func servedPlugins(cfg *config.Config) []servedPlugin {
+	if cfg.Managed {
+		return []servedPlugin{{cfg.NetworkPluginName, ""}}
+	}
+	var plugins []servedPlugin
+	if cfg.EnableNetworkDriver {
+		plugins = append(plugins, servedPlugin{cfg.NetworkPluginName, cfg.TCP.NetworkAddr})
+	}
+	if cfg.EnableIPAMDriver {
+		plugins = append(plugins, servedPlugin{cfg.IPAMPluginName, cfg.TCP.IPAMAddr})
+	}
+	return plugins
+}
+
+// newHealthChecker creates the checks run for /healthz, /readyz and
+// -healthcheck.  The plugin sockets or TCP addresses are checked for liveness,
+// the datastore for readiness, along with the Docker API and netlink if the
+// network driver is served.
+func newHealthChecker(cfg *config.Config, store *datastore.Client, dockerCli *dockerClient.Client) *health.Checker {
+	checker := health.NewChecker(healthCheckTimeout)
+	for _, plugin := range servedPlugins(cfg) {
+		if plugin.tcpAddr != "" {
+			checker.Add(plugin.name+" address", true, health.TCPCheck(plugin.tcpAddr))
+		} else {
+			checker.Add(plugin.name+" socket", true, health.SocketCheck(filepath.Join(cfg.SocketDir, plugin.name+".sock")))
+		}
+	}
+	checker.Add("datastore", false, health.DatastoreCheck(store))
+	if cfg.EnableNetworkDriver {
+		checker.Add("docker", false, health.DockerCheck(dockerCli))
+		checker.Add("netlink", false, health.NetlinkCheck())
 	}
+	return checker
+}
+
+// newPreflightChecker creates the checks run before the drivers are served and
+// by "libnetwork-plugin check", covering everything the plugin needs from this
+// host and the datastore.
+func newPreflightChecker(cfg *config.Config, store *datastore.Client, dockerCli *dockerClient.Client) *health.Checker {
+	checker := health.NewChecker(healthCheckTimeout)
+	checker.Add("node name", true, func(ctx context.Context) error {
+		_, _, err := cfg.NodeName()
+		return err
+	})
+	if cfg.EnableNetworkDriver {
+		checker.Add("netlink", true, health.NetlinkCheck())
+		checker.Add("netlink permissions", true, health.NetAdminCheck(osutils.DefaultStatusFile))
+	}
+	var onSocket, onTCP bool
+	for _, plugin := range servedPlugins(cfg) {
+		onSocket = onSocket || plugin.tcpAddr == ""
+		onTCP = onTCP || plugin.tcpAddr != ""
+	}
+	if onSocket {
+		checker.Add("plugin directory", true, health.WritableDirCheck(cfg.SocketDir))
+	}
+	if onTCP {
+		checker.Add("plugin spec directory", true, health.WritableDirCheck(cfg.TCP.SpecDir))
+	}
+	if cfg.EnableNetworkDriver {
+		checker.Add("docker", true, health.DockerCheck(dockerCli))
+	}
+	checker.Add("datastore", true, health.DatastoreCheck(store))
+	if cfg.EnableIPAMDriver {
+		// calico/node may not have created the default pools yet.
+		checker.AddWarning("IP pools", health.IPPoolCheck(store))
+	}
+	return checker
+}
+
+// preflight runs the preflight checks, returning the result of each and
+// whether they all passed.
+func preflight(cfg *config.Config) ([]health.Result, bool) {
+	datastoreConfig, err := cfg.DatastoreConfig()
+	if err != nil {
+		return []health.Result{{Name: "datastore config", Err: err}}, false
+	}
+	client, err := cfg.CalicoClient(datastoreConfig)
+	if err != nil {
+		return []health.Result{{Name: "datastore config", Err: err}}, false
+	}
+	dockerCli, err := dockerClient.NewEnvClient()
+	if err != nil {
+		return []health.Result{{Name: "docker", Err: errors.Wrap(err, "Docker client creation error")}}, false
+	}
+	defer dockerCli.Close()
+
+	return newPreflightChecker(cfg, datastore.NewClient(client, nil), dockerCli).Run(true)
+}
+
+// resolveNodeName resolves the name of the node that endpoints are created on,
+// warning if calico/node hasn't registered a node of that name, since Felix
+// ignores the endpoints of nodes it doesn't know about.
+func resolveNodeName(cfg *config.Config, store *datastore.Client) string {
+	nodeName, source, err := cfg.NodeName()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Infof("Creating endpoints on node %v, named by %v", nodeName, source)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.RPCTimeout))
+	defer cancel()
+	if _, err := store.GetNode(ctx, nodeName); err != nil {
+		if _, ok := err.(libcalicoErrors.ErrorResourceDoesNotExist); ok {
+			log.Warnf("Node %v isn't registered in the datastore, so its endpoints will be ignored; set -hostname or $NODENAME to the name calico/node uses", nodeName)
+		} else {
+			log.Warnln(errors.Wrapf(err, "Node %v checking error", nodeName))
+		}
+	}
+	return nodeName
+}
+
+// listen creates the listener that a driver is served on: a TCP address with
+// mutual TLS if one is configured, along with the discovery file telling Docker
+// about it, and otherwise a unix socket.  It returns the function that stops
+// serving on it and removes the discovery file.
+func listen(cfg *config.Config, name, tcpAddr string) (net.Listener, func(), error) {
+	if tcpAddr == "" {
+		l, err := socketutils.Listen(cfg.SocketDir, name, cfg.SocketGroup)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, func() { l.Close() }, nil
+	}
+
+	addr, err := socketutils.SpecAddr(tcpAddr, cfg.TCP.AdvertiseHost)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := socketutils.ListenTLS(tcpAddr, cfg.TCP.CertFile, cfg.TCP.KeyFile, cfg.TCP.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	specPath, err := socketutils.WriteSpec(cfg.TCP.SpecDir, socketutils.Spec{
+		Name: name,
+		Addr: addr,
+		TLSConfig: &socketutils.SpecTLS{
+			CAFile:   cfg.TCP.DockerCAFile,
+			CertFile: cfg.TCP.DockerCertFile,
+			KeyFile:  cfg.TCP.DockerKeyFile,
+		},
+	})
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return l, func() {
+		l.Close()
+		if err := os.Remove(specPath); err != nil {
+			log.Errorln(errors.Wrapf(err, "Plugin spec %v removal error", specPath))
+		}
+	}, nil
+}
+
+// healthCheck runs all the health checks against a running plugin, printing
+// the results, and returns the exit status expected by Docker's HEALTHCHECK:
+// 0 if they all passed and 1 if not.
+func healthCheck(cfg *config.Config) int {
+	datastoreConfig, err := cfg.DatastoreConfig()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	client, err := cfg.CalicoClient(datastoreConfig)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	dockerCli, err := dockerClient.NewEnvClient()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "Docker client creation error"))
+		return 1
+	}
+	defer dockerCli.Close()
+
+	results, ok := newHealthChecker(cfg, datastore.NewClient(client, nil), dockerCli).Run(true)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// collectDiags writes a diagnostics bundle for the plugin on this host, for
+// attaching to support tickets, and returns the exit status.
+func collectDiags(args []string) int {
+	flagSet := flag.NewFlagSet("Calico diags", flag.ExitOnError)
+	output := flagSet.String("o", fmt.Sprintf("calico-libnetwork-diags-%v.tar.gz", time.Now().Format("20060102-150405")), "Write the bundle to this file")
+	configFlags := config.RegisterFlags(flagSet)
+	if err := flagSet.Parse(args); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	cfg, err := configFlags.Load()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	// Whatever can't be collected is listed in the bundle's errors.txt, so
+	// carry on without the datastore if it can't be reached.
+	var store *datastore.Client
+	datastoreConfig, err := cfg.DatastoreConfig()
+	if err != nil {
+		fmt.Println(err)
+	} else if client, err := cfg.CalicoClient(datastoreConfig); err != nil {
+		fmt.Println(err)
+	} else {
+		store = datastore.NewClient(client, nil)
+	}
+	nodeName, _, err := cfg.NodeName()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Println(errors.Wrapf(err, "Diagnostics bundle %v creation error", *output))
+		return 1
+	}
+	defer f.Close()
+	if err := diags.Collect(context.Background(), f, store, diags.Options{
+		Version:      VERSION,
+		Settings:     cfg,
+		Config:       datastoreConfig,
+		Node:         nodeName,
+		Orchestrator: cfg.OrchestratorID,
+		LogFile:      cfg.Log.File,
+		Timeout:      time.Duration(cfg.RPCTimeout),
+	}); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Diagnostics written to %v\n", *output)
+	return 0
+}
+
+// check validates the config and runs the preflight checks without starting
+// the plugin, printing the results, and returns the exit status: 0 if they all
+// passed and 1 if not.
+func check(args []string) int {
+	flagSet := flag.NewFlagSet("Calico check", flag.ExitOnError)
+	configFlags := config.RegisterFlags(flagSet)
+	if err := flagSet.Parse(args); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	cfg, err := configFlags.Load()
+	if err != nil {
+		fmt.Println(health.Result{Name: "config", Err: err})
+		return 1
+	}
+	fmt.Println(health.Result{Name: "config"})
+
+	results, ok := preflight(cfg)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if !ok {
+		return 1
+	}
+	return 0
 }
 
 // VERSION is filled out during the build process (using git describe output)
 var VERSION string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diags" {
+		os.Exit(collectDiags(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+
 	// Display the version on "-v"
 	// Use a new flag set so as not to conflict with existing libraries which use "flag"
 	flagSet := flag.NewFlagSet("Calico", flag.ExitOnError)
 
 	version := flagSet.Bool("v", false, "Display version")
+	runHealthCheck := flagSet.Bool("healthcheck", false, "Check the health of the running plugin and exit")
+	skipPreflight := flagSet.Bool("skip-preflight", false, "Start without running the preflight checks")
+
+	configFlags := config.RegisterFlags(flagSet)
 	err := flagSet.Parse(os.Args[1:])
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	// The version is shown even if the config is missing or invalid.
 	if *version {
 		fmt.Println(VERSION)
 		os.Exit(0)
 	}
 
-	initializeClient()
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logging := cfg.Logging()
+	if *runHealthCheck {
+		// Docker runs the health check often, alongside the plugin, so it
+		// mustn't write to, or rotate, the plugin's log file.
+		logging.File = ""
+	}
+	if err := logutils.Configure(logging); err != nil {
+		log.Fatalln(err)
+	}
+	if *runHealthCheck {
+		os.Exit(healthCheck(cfg))
+	}
+
+	// Stop before anything is served if the plugin couldn't work on this
+	// host, rather than when the first container is started.
+	if !*skipPreflight {
+		results, ok := preflight(cfg)
+		for _, result := range results {
+			if result.Err != nil && result.Warning {
+				log.Warnf("Preflight check %v", result)
+			} else if result.Err != nil {
+				log.Errorf("Preflight check %v", result)
+			}
+		}
+		if !ok {
+			log.Fatalln("Preflight checks failed, see the errors above; start with -skip-preflight to serve anyway")
+		}
+		log.Infoln("Preflight checks passed")
+	}
 
+	// Claim the plugin sockets before anything else, so that a second
+	// instance configured with the same ones stops before it changes anything.
+	// Only the enabled drivers are listened for.
 	errChannel := make(chan error)
-	networkHandler := network.NewHandler(driver.NewNetworkDriver(client))
-	ipamHandler := ipam.NewHandler(driver.NewIpamDriver(client))
-
-	go func(c chan error) {
-		log.Infoln("calico-net has started.")
-		err := networkHandler.ServeUnix("root", networkPluginName)
-		log.Infoln("calico-net has stopped working.")
-		c <- err
-	}(errChannel)
-
-	go func(c chan error) {
-		log.Infoln("calico-ipam has started.")
-		err := ipamHandler.ServeUnix("root", ipamPluginName)
-		log.Infoln("calico-ipam has stopped working.")
-		c <- err
-	}(errChannel)
-
-	err = <-errChannel
-
-	log.Fatalln(err)
+	var networkListener, ipamListener net.Listener
+	closeNetwork, closeIPAM := func() {}, func() {}
+	if cfg.Managed {
+		// Docker only gives a managed plugin one socket, so both drivers are
+		// served on it.  Both are always enabled.
+		managedListener, closeManaged, err := listen(cfg, cfg.NetworkPluginName, "")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		closeNetwork = closeManaged
+		managed := managedutils.NewHandler()
+		networkListener = managed.Listener("NetworkDriver")
+		ipamListener = managed.Listener("IpamDriver")
+		go func(c chan error) {
+			log.Infof("Serving as a managed plugin on %v", managedListener.Addr())
+			c <- managed.Serve(managedListener)
+		}(errChannel)
+	} else {
+		if cfg.EnableNetworkDriver {
+			if networkListener, closeNetwork, err = listen(cfg, cfg.NetworkPluginName, cfg.TCP.NetworkAddr); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if cfg.EnableIPAMDriver {
+			if ipamListener, closeIPAM, err = listen(cfg, cfg.IPAMPluginName, cfg.TCP.IPAMAddr); err != nil {
+				closeNetwork()
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	initializeClient(cfg)
+
+	// Changes to the datastore are only audited if a file has been given.
+	var auditLog *audit.Log
+	if cfg.AuditLog != "" {
+		if auditLog, err = audit.Open(cfg.AuditLog); err != nil {
+			panic(err)
+		}
+	}
+	log.Infof("Log levels: %v", logutils.LevelsString())
+
+	watcher := eventsutils.NewWatcher(dockerCli)
+	store := datastore.NewClient(client, auditLog)
+	nodeName := resolveNodeName(cfg, store)
+	driverSettings := driver.NewSettings(cfg.Driver(nodeName))
+	var networkDriver driver.NetworkDriver
+	var networkHandler *network.Handler
+	var ipamHandler *ipam.Handler
+	if cfg.EnableNetworkDriver {
+		networkDriver = driver.NewNetworkDriver(store, dockerCli, watcher, retries, driverSettings).(driver.NetworkDriver)
+		networkHandler = network.NewHandler(metrics.NewNetworkDriver(networkDriver))
+	}
+	if cfg.EnableIPAMDriver {
+		ipamHandler = ipam.NewHandler(metrics.NewIpamDriver(driver.NewIpamDriver(store, retries, driverSettings)))
+	}
+
+	// Event handlers and retry executors are registered by the drivers, so
+	// only start these once the drivers have been created.  Only the network
+	// driver handles Docker events.
+	stop := make(chan struct{})
+	if cfg.EnableNetworkDriver {
+		go watcher.Run(stop)
+		go networkDriver.RunOrphanSweeps(stop)
+	}
+	go retries.Run(stop)
+
+	// Spans are only sent on if somewhere to send them has been given.
+	var traceExporter *traceutils.OTLPExporter
+	switch {
+	case cfg.Debug.TraceFile != "" && cfg.Debug.TraceEndpoint != "":
+		log.Fatalln("Only one of -trace-file and -trace-endpoint can be given")
+	case cfg.Debug.TraceFile != "":
+		if traceExporter, err = traceutils.NewFileExporter(cfg.Debug.TraceFile); err != nil {
+			panic(err)
+		}
+	case cfg.Debug.TraceEndpoint != "":
+		traceExporter = traceutils.NewHTTPExporter(cfg.Debug.TraceEndpoint)
+	}
+
+	// Spans are always recorded, so that slow calls can be broken down into
+	// their steps.
+	slowCalls := slowcallutils.NewDetector(time.Duration(cfg.Debug.SlowCallThreshold), cfg.SlowCallThresholds())
+	exporters := traceutils.Exporters{slowCalls}
+	if traceExporter != nil {
+		exporters = append(exporters, traceExporter)
+		go traceExporter.Run(stop)
+	}
+	traceutils.SetExporter(exporters)
+
+	// The settings that can be changed while running are applied when the
+	// config is reloaded.
+	reloader := config.NewReloader(configFlags, cfg, func(c *config.Config) error {
+		if err := logutils.Reconfigure(c.Logging()); err != nil {
+			return err
+		}
+		slowCalls.SetThresholds(time.Duration(c.Debug.SlowCallThreshold), c.SlowCallThresholds())
+		driverSettings.Store(c.Driver(nodeName))
+		return nil
+	})
+	go handleSignals(reloader)
+
+	debugutils.RegisterState("inFlightRequests", func() interface{} { return metrics.InFlight() })
+	debugutils.RegisterState("retryQueue", func() interface{} { return retries.Operations() })
+	debugutils.RegisterState("slowestCalls", func() interface{} { return slowCalls.Slowest(slowestCallsShown) })
+	debugutils.RegisterState("logLevels", func() interface{} { return logutils.Levels() })
+
+	// The debug endpoint is only served if an address has been given, and
+	// never on a public interface.  So the handlers that change the plugin's
+	// state are served there too, rather than with the metrics.
+	if cfg.Debug.Listen != "" {
+		debugListener, err := debugutils.Listen(cfg.Debug.Listen)
+		if err != nil {
+			panic(err)
+		}
+		go func(c chan error) {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/", debugutils.Handler())
+			mux.Handle("/loglevel", logutils.LevelHandler())
+			mux.Handle("/reload", reloader.Handler())
+			log.Infof("Serving debug endpoint, log levels and config reloads on %v", cfg.Debug.Listen)
+			c <- http.Serve(debugListener, mux)
+		}(errChannel)
+	}
+
+	// Metrics and health checks are only served if an address to listen on
+	// has been given.
+	if httpAddr := cfg.HTTPAddr; httpAddr != "" {
+		if cfg.EnableNetworkDriver {
+			metrics.RegisterNodeCollector(store, driverSettings)
+		}
+		checker := newHealthChecker(cfg, store, dockerCli)
+		go func(c chan error) {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.Handle("/healthz", checker.HealthzHandler())
+			mux.Handle("/readyz", checker.ReadyzHandler())
+			mux.Handle("/slowcalls", slowCalls.Handler(slowestCallsShown))
+			log.Infof("Serving metrics, health checks and slow calls on %v", httpAddr)
+			c <- http.ListenAndServe(httpAddr, mux)
+		}(errChannel)
+	}
+
+	if networkHandler != nil {
+		go func(c chan error) {
+			log.Infoln("calico-net has started.")
+			err := networkHandler.Serve(networkListener)
+			log.Infoln("calico-net has stopped working.")
+			c <- err
+		}(errChannel)
+	}
+
+	if ipamHandler != nil {
+		go func(c chan error) {
+			log.Infoln("calico-ipam has started.")
+			err := ipamHandler.Serve(ipamListener)
+			log.Infoln("calico-ipam has stopped working.")
+			c <- err
+		}(errChannel)
+	}
+
+	// Stop if serving fails or on SIGINT or SIGTERM, removing the sockets and
+	// discovery files so that Docker doesn't try to use them.
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errChannel:
+	case sig := <-shutdown:
+		log.Infof("Received %v, stopping", sig)
+	}
+	close(stop)
+	closeNetwork()
+	closeIPAM()
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
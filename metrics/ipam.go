@@ -0,0 +1,50 @@
+package metrics
+
+import "github.com/docker/go-plugins-helpers/ipam"
+
+const ipamDriverLabel = "ipam"
+
+// IpamDriver records metrics for each call to the IPAM driver it wraps.
+type IpamDriver struct {
+	driver ipam.Ipam
+}
+
+func NewIpamDriver(driver ipam.Ipam) ipam.Ipam {
+	return IpamDriver{driver: driver}
+}
+
+func (i IpamDriver) GetCapabilities() (res *ipam.CapabilitiesResponse, err error) {
+	end := start(ipamDriverLabel, "GetCapabilities")
+	defer func() { end(err) }()
+	return i.driver.GetCapabilities()
+}
+
+func (i IpamDriver) GetDefaultAddressSpaces() (res *ipam.AddressSpacesResponse, err error) {
+	end := start(ipamDriverLabel, "GetDefaultAddressSpaces")
+	defer func() { end(err) }()
+	return i.driver.GetDefaultAddressSpaces()
+}
+
+func (i IpamDriver) RequestPool(request *ipam.RequestPoolRequest) (res *ipam.RequestPoolResponse, err error) {
+	end := start(ipamDriverLabel, "RequestPool")
+	defer func() { end(err) }()
+	return i.driver.RequestPool(request)
+}
+
+func (i IpamDriver) ReleasePool(request *ipam.ReleasePoolRequest) (err error) {
+	end := start(ipamDriverLabel, "ReleasePool")
+	defer func() { end(err) }()
+	return i.driver.ReleasePool(request)
+}
+
+func (i IpamDriver) RequestAddress(request *ipam.RequestAddressRequest) (res *ipam.RequestAddressResponse, err error) {
+	end := start(ipamDriverLabel, "RequestAddress")
+	defer func() { end(err) }()
+	return i.driver.RequestAddress(request)
+}
+
+func (i IpamDriver) ReleaseAddress(request *ipam.ReleaseAddressRequest) (err error) {
+	end := start(ipamDriverLabel, "ReleaseAddress")
+	defer func() { end(err) }()
+	return i.driver.ReleaseAddress(request)
+}
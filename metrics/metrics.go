@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "calico_libnetwork"
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of libnetwork requests handled, by driver and method.",
+	}, []string{"driver", "method"})
+
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_errors_total",
+		Help:      "Number of libnetwork requests that returned an error, by driver and method.",
+	}, []string{"driver", "method"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle libnetwork requests, by driver and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"driver", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestErrors, requestDuration)
+}
+
+// Handler serves the registered metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Call is a driver method call that is in progress.
+type Call struct {
+	Driver  string    `json:"driver"`
+	Method  string    `json:"method"`
+	Started time.Time `json:"started"`
+}
+
+var (
+	inFlightMutex sync.Mutex
+	inFlight      = map[int]Call{}
+	nextCallID    int
+)
+
+// InFlight returns the driver method calls in progress, oldest first.
+func InFlight() []Call {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+
+	calls := make([]Call, 0, len(inFlight))
+	for _, call := range inFlight {
+		calls = append(calls, call)
+	}
+	sort.Sort(byStarted(calls))
+	return calls
+}
+
+type byStarted []Call
+
+func (c byStarted) Len() int           { return len(c) }
+func (c byStarted) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byStarted) Less(i, j int) bool { return c[i].Started.Before(c[j].Started) }
+
+// start records that a call to a driver method has started, returning the
+// function that records its end.
+func start(driver, method string) func(err error) {
+	started := time.Now()
+	inFlightMutex.Lock()
+	id := nextCallID
+	nextCallID++
+	inFlight[id] = Call{Driver: driver, Method: method, Started: started}
+	inFlightMutex.Unlock()
+
+	return func(err error) {
+		inFlightMutex.Lock()
+		delete(inFlight, id)
+		inFlightMutex.Unlock()
+		observe(driver, method, started, err)
+	}
+}
+
+// observe records a call to a driver method that started at the given time.
+func observe(driver, method string, start time.Time, err error) {
+	requests.WithLabelValues(driver, method).Inc()
+	requestDuration.WithLabelValues(driver, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestErrors.WithLabelValues(driver, method).Inc()
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// scrape returns the value of each series that handler serves, by its name and
+// labels, e.g. `calico_libnetwork_requests_total{driver="ipam",method="RequestPool"}`.
+func scrape(handler http.Handler) map[string]float64 {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	Expect(w.Code).To(Equal(http.StatusOK))
+
+	values := map[string]float64{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		Expect(err).NotTo(HaveOccurred())
+		values[line[:i]] = value
+	}
+	return values
+}
+
+type fakeNetworkDriver struct {
+	network.Driver
+	inFlight []Call
+}
+
+func (d *fakeNetworkDriver) CreateNetwork(request *network.CreateNetworkRequest) error {
+	d.inFlight = InFlight()
+	return nil
+}
+
+func (d *fakeNetworkDriver) Join(request *network.JoinRequest) (*network.JoinResponse, error) {
+	if request.EndpointID == "" {
+		return nil, errors.New("no endpoint")
+	}
+	return &network.JoinResponse{}, nil
+}
+
+type fakeIpamDriver struct {
+	ipam.Ipam
+}
+
+func (i fakeIpamDriver) ReleaseAddress(request *ipam.ReleaseAddressRequest) error {
+	if request.Address == "" {
+		return errors.New("no address")
+	}
+	return nil
+}
+
+var _ = Describe("Driver metrics", func() {
+	It("counts, times and counts the errors of each network driver method", func() {
+		d := NewNetworkDriver(&fakeNetworkDriver{})
+		before := scrape(Handler())
+
+		_, err := d.Join(&network.JoinRequest{EndpointID: "ep1"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = d.Join(&network.JoinRequest{})
+		Expect(err).To(MatchError("no endpoint"))
+
+		after := scrape(Handler())
+		series := `{driver="network",method="Join"}`
+		Expect(after["calico_libnetwork_requests_total"+series] - before["calico_libnetwork_requests_total"+series]).To(Equal(2.0))
+		Expect(after["calico_libnetwork_request_errors_total"+series] - before["calico_libnetwork_request_errors_total"+series]).To(Equal(1.0))
+		Expect(after["calico_libnetwork_request_duration_seconds_count"+series] - before["calico_libnetwork_request_duration_seconds_count"+series]).To(Equal(2.0))
+	})
+
+	It("counts, times and counts the errors of each IPAM driver method", func() {
+		i := NewIpamDriver(fakeIpamDriver{})
+		before := scrape(Handler())
+
+		Expect(i.ReleaseAddress(&ipam.ReleaseAddressRequest{Address: "10.0.0.1"})).To(Succeed())
+		Expect(i.ReleaseAddress(&ipam.ReleaseAddressRequest{})).To(MatchError("no address"))
+		Expect(i.ReleaseAddress(&ipam.ReleaseAddressRequest{})).To(MatchError("no address"))
+
+		after := scrape(Handler())
+		series := `{driver="ipam",method="ReleaseAddress"}`
+		Expect(after["calico_libnetwork_requests_total"+series] - before["calico_libnetwork_requests_total"+series]).To(Equal(3.0))
+		Expect(after["calico_libnetwork_request_errors_total"+series] - before["calico_libnetwork_request_errors_total"+series]).To(Equal(2.0))
+		Expect(after["calico_libnetwork_request_duration_seconds_count"+series] - before["calico_libnetwork_request_duration_seconds_count"+series]).To(Equal(3.0))
+	})
+
+	It("lists the calls in progress", func() {
+		fake := &fakeNetworkDriver{}
+		Expect(NewNetworkDriver(fake).CreateNetwork(&network.CreateNetworkRequest{})).To(Succeed())
+
+		Expect(fake.inFlight).To(HaveLen(1))
+		Expect(fake.inFlight[0].Driver).To(Equal("network"))
+		Expect(fake.inFlight[0].Method).To(Equal("CreateNetwork"))
+		Expect(InFlight()).To(BeEmpty())
+	})
+})
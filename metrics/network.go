@@ -0,0 +1,86 @@
+package metrics
+
+import "github.com/docker/go-plugins-helpers/network"
+
+const networkDriverLabel = "network"
+
+// NetworkDriver records metrics for each call to the network driver it wraps.
+type NetworkDriver struct {
+	driver network.Driver
+}
+
+func NewNetworkDriver(driver network.Driver) network.Driver {
+	return NetworkDriver{driver: driver}
+}
+
+func (d NetworkDriver) GetCapabilities() (res *network.CapabilitiesResponse, err error) {
+	end := start(networkDriverLabel, "GetCapabilities")
+	defer func() { end(err) }()
+	return d.driver.GetCapabilities()
+}
+
+func (d NetworkDriver) CreateNetwork(request *network.CreateNetworkRequest) (err error) {
+	end := start(networkDriverLabel, "CreateNetwork")
+	defer func() { end(err) }()
+	return d.driver.CreateNetwork(request)
+}
+
+func (d NetworkDriver) DeleteNetwork(request *network.DeleteNetworkRequest) (err error) {
+	end := start(networkDriverLabel, "DeleteNetwork")
+	defer func() { end(err) }()
+	return d.driver.DeleteNetwork(request)
+}
+
+func (d NetworkDriver) CreateEndpoint(request *network.CreateEndpointRequest) (res *network.CreateEndpointResponse, err error) {
+	end := start(networkDriverLabel, "CreateEndpoint")
+	defer func() { end(err) }()
+	return d.driver.CreateEndpoint(request)
+}
+
+func (d NetworkDriver) DeleteEndpoint(request *network.DeleteEndpointRequest) (err error) {
+	end := start(networkDriverLabel, "DeleteEndpoint")
+	defer func() { end(err) }()
+	return d.driver.DeleteEndpoint(request)
+}
+
+func (d NetworkDriver) EndpointInfo(request *network.InfoRequest) (res *network.InfoResponse, err error) {
+	end := start(networkDriverLabel, "EndpointInfo")
+	defer func() { end(err) }()
+	return d.driver.EndpointInfo(request)
+}
+
+func (d NetworkDriver) Join(request *network.JoinRequest) (res *network.JoinResponse, err error) {
+	end := start(networkDriverLabel, "Join")
+	defer func() { end(err) }()
+	return d.driver.Join(request)
+}
+
+func (d NetworkDriver) Leave(request *network.LeaveRequest) (err error) {
+	end := start(networkDriverLabel, "Leave")
+	defer func() { end(err) }()
+	return d.driver.Leave(request)
+}
+
+func (d NetworkDriver) DiscoverNew(request *network.DiscoveryNotification) (err error) {
+	end := start(networkDriverLabel, "DiscoverNew")
+	defer func() { end(err) }()
+	return d.driver.DiscoverNew(request)
+}
+
+func (d NetworkDriver) DiscoverDelete(request *network.DiscoveryNotification) (err error) {
+	end := start(networkDriverLabel, "DiscoverDelete")
+	defer func() { end(err) }()
+	return d.driver.DiscoverDelete(request)
+}
+
+func (d NetworkDriver) ProgramExternalConnectivity(request *network.ProgramExternalConnectivityRequest) (err error) {
+	end := start(networkDriverLabel, "ProgramExternalConnectivity")
+	defer func() { end(err) }()
+	return d.driver.ProgramExternalConnectivity(request)
+}
+
+func (d NetworkDriver) RevokeExternalConnectivity(request *network.RevokeExternalConnectivityRequest) (err error) {
+	end := start(networkDriverLabel, "RevokeExternalConnectivity")
+	defer func() { end(err) }()
+	return d.driver.RevokeExternalConnectivity(request)
+}
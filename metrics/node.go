@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	"github.com/projectcalico/libnetwork-plugin/driver"
+)
+
+var (
+	endpointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "endpoints"),
+		"Number of Calico endpoints created by libnetwork on this node.",
+		nil, nil)
+
+	addressesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "endpoint_addresses"),
+		"Number of IP addresses on the Calico endpoints on this node, by IP version. Addresses allocated by IPAM but not on an endpoint, such as those used by other network drivers, aren't counted.",
+		[]string{"version"}, nil)
+)
+
+// nodeCollector reports the endpoints and addresses on this node, as read from
+// the datastore each time the metrics are scraped.  The addresses are those on
+// the endpoints rather than those allocated by IPAM, which can't be listed by
+// node, so addresses handed to other network drivers by the IPAM driver, or
+// left allocated after a failed CreateEndpoint, aren't counted.
+type nodeCollector struct {
+	client   *datastore.Client
+	settings *driver.Settings
+}
+
+// RegisterNodeCollector adds gauges for the endpoints and their addresses on
+// this node.  Each scrape lists the node's endpoints, bounded by the
+// drivers' RPC timeout.  Only the network driver creates endpoints, so the
+// gauges are meaningless unless it is served.
+func RegisterNodeCollector(client *datastore.Client, settings *driver.Settings) {
+	prometheus.MustRegister(nodeCollector{client: client, settings: settings})
+}
+
+func (c nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- endpointsDesc
+	ch <- addressesDesc
+}
+
+func (c nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.settings.Load()
+	ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+	defer cancel()
+	hostname := config.NodeName
+	endpoints, err := c.client.ListWorkloadEndpoints(ctx, api.WorkloadEndpointMetadata{
+		Node:         hostname,
+		Orchestrator: config.OrchestratorID,
+		Workload:     config.WorkloadID})
+	if err != nil {
+		log.Errorln(errors.Wrap(err, "Workload endpoints listing error"))
+		return
+	}
+
+	addresses := map[int]int{4: 0, 6: 0}
+	for _, endpoint := range endpoints.Items {
+		for _, ipNet := range endpoint.Spec.IPNetworks {
+			addresses[ipNet.Version()]++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(endpointsDesc, prometheus.GaugeValue, float64(len(endpoints.Items)))
+	ch <- prometheus.MustNewConstMetric(addressesDesc, prometheus.GaugeValue, float64(addresses[4]), "4")
+	ch <- prometheus.MustNewConstMetric(addressesDesc, prometheus.GaugeValue, float64(addresses[6]), "6")
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	caliconet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/projectcalico/libnetwork-plugin/datastore"
+	"github.com/projectcalico/libnetwork-plugin/driver"
+)
+
+var _ = Describe("Node collector", func() {
+	var dir string
+	var store *datastore.Client
+	var handler http.Handler
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "metrics")
+		Expect(err).NotTo(HaveOccurred())
+		local, err := datastore.OpenLocal(datastore.LocalConfig{File: filepath.Join(dir, "datastore.json"), NodeName: "node1"})
+		Expect(err).NotTo(HaveOccurred())
+		store = datastore.NewClient(local, nil)
+
+		config := driver.DefaultConfig()
+		config.NodeName = "node1"
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(nodeCollector{client: store, settings: driver.NewSettings(config)})
+		handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	create := func(node, orchestrator, name string, cidrs ...string) {
+		endpoint := api.NewWorkloadEndpoint()
+		endpoint.Metadata.Node = node
+		endpoint.Metadata.Orchestrator = orchestrator
+		endpoint.Metadata.Workload = "libnetwork"
+		endpoint.Metadata.Name = name
+		for _, cidr := range cidrs {
+			_, ipNet, err := caliconet.ParseCIDR(cidr)
+			Expect(err).NotTo(HaveOccurred())
+			endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, *ipNet)
+		}
+		Expect(store.CreateWorkloadEndpoint(context.Background(), endpoint)).To(Succeed())
+	}
+
+	It("reports zero on a node without endpoints", func() {
+		Expect(scrape(handler)).To(Equal(map[string]float64{
+			"calico_libnetwork_endpoints":                       0,
+			`calico_libnetwork_endpoint_addresses{version="4"}`: 0,
+			`calico_libnetwork_endpoint_addresses{version="6"}`: 0,
+		}))
+	})
+
+	It("counts the endpoints libnetwork created on this node and their addresses", func() {
+		create("node1", "libnetwork", "ep1", "10.0.0.1/32")
+		create("node1", "libnetwork", "ep2", "10.0.0.2/32", "fd00::2/128")
+		create("node2", "libnetwork", "ep3", "10.0.0.3/32")
+		create("node1", "k8s", "ep4", "10.0.0.4/32")
+
+		Expect(scrape(handler)).To(Equal(map[string]float64{
+			"calico_libnetwork_endpoints":                       2,
+			`calico_libnetwork_endpoint_addresses{version="4"}`: 2,
+			`calico_libnetwork_endpoint_addresses{version="6"}`: 1,
+		}))
+	})
+})
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+)
+
+// Outcomes of an audited operation.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Record describes one mutating datastore operation, and the request that it
+// was made for.
+type Record struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	EndpointID    string    `json:"endpointID,omitempty"`
+	NetworkID     string    `json:"networkID,omitempty"`
+	CorrelationID string    `json:"correlationID,omitempty"`
+	Operation     string    `json:"operation"`
+	Key           string    `json:"key"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type request struct {
+	method     string
+	endpointID string
+	networkID  string
+}
+
+type requestKey struct{}
+
+// WithRequest returns a context recording the libnetwork method, or other
+// reason such as a Docker event, that datastore operations are made for,
+// along with the endpoint and network IDs if known.
+func WithRequest(ctx context.Context, method, endpointID, networkID string) context.Context {
+	return context.WithValue(ctx, requestKey{}, request{method: method, endpointID: endpointID, networkID: networkID})
+}
+
+// Log is an append-only file of audit records, one JSON object per line.  A
+// nil Log discards records, so auditing can be disabled by not opening one.
+type Log struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// Open opens the audit log at path for appending, creating it if needed.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "Audit log %v opening error", path)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Audit log %v opening error", path)
+	}
+	return &Log{file: file}, nil
+}
+
+// Record appends a record of an operation on the object with the given key,
+// made for the request carried by the context.  err is the operation's error,
+// if it failed.
+func (l *Log) Record(ctx context.Context, operation, key string, err error) {
+	if l == nil {
+		return
+	}
+
+	req, _ := ctx.Value(requestKey{}).(request)
+	record := Record{
+		Time:          time.Now().UTC(),
+		Method:        req.method,
+		EndpointID:    req.endpointID,
+		NetworkID:     req.networkID,
+		CorrelationID: logutils.CorrelationID(ctx),
+		Operation:     operation,
+		Key:           key,
+		Outcome:       OutcomeSuccess,
+	}
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = err.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Errorln(errors.Wrap(err, "Audit record encoding error"))
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Errorln(errors.Wrapf(err, "Audit log %v writing error", l.file.Name()))
+	}
+}
+
+// Close closes the audit log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+)
+
+var _ = Describe("Audit log", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "audit.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	readRecords := func() []Record {
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		var records []Record
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record Record
+			Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+			records = append(records, record)
+		}
+		return records
+	}
+
+	It("records the request and outcome of each operation", func() {
+		l, err := Open(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx := logutils.WithCorrelationID(context.Background(), "ep1")
+		ctx = WithRequest(ctx, "CreateEndpoint", "ep1", "net1")
+		l.Record(ctx, "CreateProfile", "profile/net", errors.New("already exists"))
+		l.Record(ctx, "CreateWorkloadEndpoint", "workloadEndpoint/host/libnetwork/libnetwork/ep1", nil)
+		Expect(l.Close()).To(Succeed())
+
+		records := readRecords()
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Method).To(Equal("CreateEndpoint"))
+		Expect(records[0].EndpointID).To(Equal("ep1"))
+		Expect(records[0].NetworkID).To(Equal("net1"))
+		Expect(records[0].CorrelationID).To(Equal("ep1"))
+		Expect(records[0].Outcome).To(Equal(OutcomeFailure))
+		Expect(records[0].Error).To(Equal("already exists"))
+		Expect(records[1].Operation).To(Equal("CreateWorkloadEndpoint"))
+		Expect(records[1].Outcome).To(Equal(OutcomeSuccess))
+		Expect(records[1].Time).NotTo(BeZero())
+	})
+
+	It("appends to an existing log", func() {
+		for i := 0; i < 2; i++ {
+			l, err := Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			l.Record(context.Background(), "AssignIP", "ip/10.0.0.1", nil)
+			Expect(l.Close()).To(Succeed())
+		}
+		Expect(readRecords()).To(HaveLen(2))
+	})
+
+	It("discards records if auditing is disabled", func() {
+		var l *Log
+		l.Record(context.Background(), "AssignIP", "ip/10.0.0.1", nil)
+		Expect(l.Close()).To(Succeed())
+	})
+})
@@ -0,0 +1,108 @@
+package debug
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// StateFunc returns a snapshot of some internal state, which must be
+// encodable as JSON.
+type StateFunc func() interface{}
+
+var (
+	stateMutex sync.Mutex
+	stateFuncs = map[string]StateFunc{}
+)
+
+// RegisterState adds internal state to the dump served at /debug/state, under
+// the given name.  Registering a name again replaces the previous function.
+func RegisterState(name string, f StateFunc) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	stateFuncs[name] = f
+}
+
+// State returns a snapshot of all the registered state.
+func State() map[string]interface{} {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state := map[string]interface{}{}
+	for name, f := range stateFuncs {
+		state[name] = f()
+	}
+	return state
+}
+
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(State()); err != nil {
+		log.Errorln(errors.Wrap(err, "Debug state encoding error"))
+	}
+}
+
+// Handler serves pprof under /debug/pprof/ and the registered state at
+// /debug/state.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", stateHandler)
+	return mux
+}
+
+// Listen creates the listener for the debug endpoint.  The address is either
+// the path of a unix socket, optionally prefixed with "unix://", or a TCP
+// address on a loopback interface, such as "localhost:6060".
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix://"); strings.HasPrefix(path, "/") {
+		// Remove any socket left behind by a previous run.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Debug socket %v removal error", path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Debug socket %v listening error", path)
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Debug address %v parsing error", addr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.Errorf("Debug address %v must be a unix socket or on a loopback interface", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Debug address %v listening error", addr)
+	}
+	return l, nil
+}
+
+// Stacks returns the stacks of all goroutines.
+func Stacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,49 @@
+package debug
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Debug endpoint", func() {
+	It("only listens on unix sockets and loopback addresses", func() {
+		_, err := Listen("0.0.0.0:0")
+		Expect(err).To(HaveOccurred())
+		_, err = Listen("10.0.0.1:6060")
+		Expect(err).To(HaveOccurred())
+
+		l, err := Listen("127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Close()).To(Succeed())
+
+		dir, err := ioutil.TempDir("", "debug")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		l, err = Listen("unix://" + filepath.Join(dir, "debug.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Close()).To(Succeed())
+	})
+
+	It("dumps the registered state", func() {
+		RegisterState("cache", func() interface{} { return map[string]string{"net1": "calico"} })
+
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/state", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		var state map[string]map[string]string
+		Expect(json.Unmarshal(w.Body.Bytes(), &state)).To(Succeed())
+		Expect(state).To(HaveKeyWithValue("cache", map[string]string{"net1": "calico"}))
+	})
+
+	It("returns the stacks of all goroutines", func() {
+		Expect(string(Stacks())).To(ContainSubstring("goroutine"))
+	})
+})
@@ -0,0 +1,112 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	dockerEvents "github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// The delays between attempts to re-establish the event stream, which are
+// deliberately fixed, as the README says.
+const (
+	minRetryInterval = 1 * time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+// Handler is called for each Docker event of the type it was registered for.
+type Handler func(msg dockerEvents.Message)
+
+// Watcher subscribes to the Docker events stream and dispatches each event to
+// the handlers registered for its type.  If the stream fails it is
+// re-established with an increasing delay between attempts.
+//
+// Handlers must be registered before Run is called.  They are called one at a
+// time, in the order Docker reports the events.
+type Watcher struct {
+	dockerCli      *dockerClient.Client
+	handlers       map[string][]Handler
+	resyncHandlers []func()
+}
+
+func NewWatcher(dockerCli *dockerClient.Client) *Watcher {
+	return &Watcher{
+		dockerCli: dockerCli,
+		handlers:  map[string][]Handler{},
+	}
+}
+
+// Handle registers a handler for events of the given type, e.g.
+// events.ContainerEventType from the Docker API types.
+func (w *Watcher) Handle(eventType string, handler Handler) {
+	w.handlers[eventType] = append(w.handlers[eventType], handler)
+}
+
+// OnResync registers a function that is called whenever the subscription is
+// (re-)established.  Events may have been missed while the stream was down, so
+// anything derived from them should be refreshed.
+func (w *Watcher) OnResync(f func()) {
+	w.resyncHandlers = append(w.resyncHandlers, f)
+}
+
+// Run watches for events until the stop channel is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	eventFilters := filters.NewArgs()
+	for eventType := range w.handlers {
+		eventFilters.Add("type", eventType)
+	}
+
+	retryInterval := minRetryInterval
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		messages, errs := w.dockerCli.Events(ctx, types.EventsOptions{Filters: eventFilters})
+		log.Debugln("Subscribed to Docker events")
+		for _, f := range w.resyncHandlers {
+			f()
+		}
+
+		err := w.dispatch(messages, errs, stop, &retryInterval)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		log.Warnf("Lost Docker event stream, retrying in %v: %v", retryInterval, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(retryInterval):
+		}
+		if retryInterval *= 2; retryInterval > maxRetryInterval {
+			retryInterval = maxRetryInterval
+		}
+	}
+}
+
+// dispatch passes events to their handlers until the stream fails, returning
+// the error, or the stop channel is closed, returning nil.  The retry interval
+// is reset once events are being received again.
+func (w *Watcher) dispatch(messages <-chan dockerEvents.Message, errs <-chan error, stop <-chan struct{}, retryInterval *time.Duration) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-errs:
+			if err == nil {
+				err = errors.New("Event stream closed")
+			}
+			return err
+		case msg := <-messages:
+			*retryInterval = minRetryInterval
+			log.Debugf("Docker event: type=%v action=%v id=%v", msg.Type, msg.Action, msg.Actor.ID)
+			for _, handler := range w.handlers[msg.Type] {
+				handler(msg)
+			}
+		}
+	}
+}
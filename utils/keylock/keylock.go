@@ -0,0 +1,80 @@
+package keylock
+
+import (
+	"sync"
+	"time"
+)
+
+// Locker serializes operations that share a key, such as an endpoint ID or an
+// IP address, while letting operations on different keys run in parallel.
+// Locks are created on demand and discarded once nothing holds or waits for
+// them.
+type Locker struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// The number of callers holding or waiting for the lock, and when it was
+	// last acquired.  Guarded by the Locker's mutex.
+	refs       int
+	acquiredAt time.Time
+}
+
+// State describes a lock that is held, for debugging.
+type State struct {
+	HeldSince time.Time `json:"heldSince"`
+	Waiters   int       `json:"waiters"`
+}
+
+func New() *Locker {
+	return &Locker{locks: map[string]*keyLock{}}
+}
+
+// Lock blocks until no other caller holds the lock for key, and returns the
+// function that releases it.
+func (l *Locker) Lock(key string) (unlock func()) {
+	l.mutex.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	l.mutex.Lock()
+	lock.acquiredAt = time.Now()
+	l.mutex.Unlock()
+
+	return func() {
+		// Forget the lock before releasing it, so that the next caller to
+		// acquire it isn't mistaken for its previous holder.
+		l.mutex.Lock()
+		lock.acquiredAt = time.Time{}
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mutex.Unlock()
+
+		lock.Unlock()
+	}
+}
+
+// Held returns the state of each lock that is held, keyed on the lock's key.
+func (l *Locker) Held() map[string]State {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	held := map[string]State{}
+	for key, lock := range l.locks {
+		// A lock that is only being waited for hasn't been acquired yet.
+		if lock.acquiredAt.IsZero() {
+			continue
+		}
+		held[key] = State{HeldSince: lock.acquiredAt, Waiters: lock.refs - 1}
+	}
+	return held
+}
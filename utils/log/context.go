@@ -0,0 +1,65 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+
+	logger "github.com/Sirupsen/logrus"
+)
+
+// CorrelationIDField is the field carrying the correlation ID on each message
+// logged for a request.
+const CorrelationIDField = "correlation_id"
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a context carrying a correlation ID, which ties
+// together the messages logged while handling one request.  The ID is
+// normally the ID of the endpoint or network the request is for; if id is
+// empty a random one is generated.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		id = newCorrelationID()
+	}
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, if any.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Entry is a log entry for a subsystem that carries the correlation ID of the
+// request it is logging for.
+type Entry struct {
+	*logger.Entry
+	logger *Logger
+}
+
+// WithContext returns an entry for logging with the correlation ID carried by
+// the context.
+func (l *Logger) WithContext(ctx context.Context) *Entry {
+	entry := logger.NewEntry(l.Logger)
+	if id := CorrelationID(ctx); id != "" {
+		entry = entry.WithField(CorrelationIDField, id)
+	}
+	return &Entry{Entry: entry, logger: l}
+}
+
+// Tracef logs a message at debug level if the subsystem is at trace level.
+func (e *Entry) Tracef(format string, args ...interface{}) {
+	if atomic.LoadInt32(&e.logger.trace) != 0 {
+		e.WithField("trace", true).Debugf(format, args...)
+	}
+}
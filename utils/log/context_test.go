@@ -0,0 +1,42 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Correlation IDs", func() {
+	var out *bytes.Buffer
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		Network.Out = out
+	})
+
+	AfterEach(func() {
+		Network.Out = os.Stderr
+	})
+
+	It("adds the ID carried by the context to each message", func() {
+		ctx := WithCorrelationID(context.Background(), "ep1234")
+		Network.WithContext(ctx).Infof("Creating endpoint")
+		Expect(out.String()).To(ContainSubstring("correlation_id=ep1234"))
+		Expect(out.String()).To(ContainSubstring("subsystem=network"))
+	})
+
+	It("generates an ID if none is given", func() {
+		first := CorrelationID(WithCorrelationID(context.Background(), ""))
+		second := CorrelationID(WithCorrelationID(context.Background(), ""))
+		Expect(first).To(HaveLen(16))
+		Expect(first).NotTo(Equal(second))
+	})
+
+	It("logs without an ID for contexts that don't carry one", func() {
+		Network.WithContext(context.Background()).Infof("Event stream lost")
+		Expect(out.String()).NotTo(ContainSubstring("correlation_id"))
+	})
+})
@@ -0,0 +1,34 @@
+package log
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LevelHandler serves the log level of each subsystem on GET, one
+// subsystem=level pair per line.  A PUT or POST with a "level" parameter sets
+// the level of the subsystem given by the "subsystem" parameter, or of every
+// subsystem if that is omitted.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			subsystem, level := r.FormValue("subsystem"), r.FormValue("level")
+			if err := SetLevel(subsystem, level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Plugin.Infof("Log levels changed to %v", LevelsString())
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		levels := Levels()
+		for _, name := range Subsystems() {
+			fmt.Fprintf(w, "%v=%v\n", name, levels[name])
+		}
+	})
+}
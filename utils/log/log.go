@@ -2,15 +2,93 @@ package log
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 
 	logger "github.com/Sirupsen/logrus"
 )
 
-func JSONMessage(formattedMessage string, data interface{}) {
-	requestJSON, err := json.Marshal(data)
+const (
+	// DefaultMaxJSONLength is the default limit on the length of the JSON
+	// logged by JSONMessage.
+	DefaultMaxJSONLength = 4096
+
+	redacted = "[REDACTED]"
+)
+
+var (
+	// payloadMutex guards the payload settings, which can be changed while
+	// requests are being logged.
+	payloadMutex sync.RWMutex
+
+	// Payloads longer than this are truncated, unless it is zero.
+	maxJSONLength = DefaultMaxJSONLength
+
+	// Values with these keys, in lower case, are redacted wherever they
+	// appear in a payload.
+	redactKeys = map[string]bool{}
+)
+
+// JSONMessage logs a request or response.  The message is logged at info
+// level; the payload is only added, as JSON, if the subsystem is at debug
+// level.  Values whose keys are configured for redaction are replaced, and
+// the JSON is truncated if it is too long.
+func (e *Entry) JSONMessage(formattedMessage string, data interface{}) {
+	if !e.logger.enabled(logger.DebugLevel) {
+		e.Info(formattedMessage)
+		return
+	}
+
+	requestJSON, err := formatJSON(data)
 	if err != nil {
-		logger.Fatal(err)
+		e.WithField("JSONError", err.Error()).Debug(formattedMessage)
 		return
 	}
-	logger.WithField("JSON", string(requestJSON)).Info(formattedMessage)
+	e.WithField("JSON", requestJSON).Debug(formattedMessage)
+}
+
+func formatJSON(data interface{}) (string, error) {
+	payloadMutex.RLock()
+	maxJSONLength, redactKeys := maxJSONLength, redactKeys
+	payloadMutex.RUnlock()
+
+	requestJSON, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	if len(redactKeys) > 0 {
+		// Round trip through a generic value so keys can be found at any depth.
+		var generic interface{}
+		if err := json.Unmarshal(requestJSON, &generic); err != nil {
+			return "", err
+		}
+		if requestJSON, err = json.Marshal(redact(generic, redactKeys)); err != nil {
+			return "", err
+		}
+	}
+
+	if maxJSONLength > 0 && len(requestJSON) > maxJSONLength {
+		return fmt.Sprintf("%s...(%d bytes truncated)", requestJSON[:maxJSONLength], len(requestJSON)-maxJSONLength), nil
+	}
+	return string(requestJSON), nil
+}
+
+func redact(value interface{}, redactKeys map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if redactKeys[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redact(nested, redactKeys)
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = redact(nested, redactKeys)
+		}
+	}
+	return value
 }
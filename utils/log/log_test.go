@@ -0,0 +1,67 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSONMessage", func() {
+	var out *bytes.Buffer
+	var log *Entry
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		Network.Out = out
+		log = Network.WithContext(context.Background())
+		Expect(SetLevel(SubsystemNetwork, "debug")).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Network.Out = os.Stderr
+		Expect(SetLevel(SubsystemNetwork, "info")).To(Succeed())
+		maxJSONLength = DefaultMaxJSONLength
+		redactKeys = map[string]bool{}
+	})
+
+	It("only logs the payload at debug level", func() {
+		Expect(SetLevel(SubsystemNetwork, "info")).To(Succeed())
+		log.JSONMessage("CreateEndpoint", map[string]string{"EndpointID": "ep1"})
+		Expect(out.String()).To(ContainSubstring("CreateEndpoint"))
+		Expect(out.String()).NotTo(ContainSubstring("ep1"))
+
+		out.Reset()
+		Expect(SetLevel(SubsystemNetwork, "debug")).To(Succeed())
+		log.JSONMessage("CreateEndpoint", map[string]string{"EndpointID": "ep1"})
+		Expect(out.String()).To(ContainSubstring("ep1"))
+	})
+
+	It("logs the marshalling error instead of exiting", func() {
+		log.JSONMessage("Join", map[string]interface{}{"bad": make(chan int)})
+		Expect(out.String()).To(ContainSubstring("Join"))
+		Expect(out.String()).To(ContainSubstring("JSONError"))
+	})
+
+	It("truncates long payloads", func() {
+		maxJSONLength = 20
+		log.JSONMessage("Join", map[string]string{"long": strings.Repeat("x", 100)})
+		Expect(out.String()).To(ContainSubstring("bytes truncated"))
+		Expect(out.String()).NotTo(ContainSubstring(strings.Repeat("x", 30)))
+	})
+
+	It("redacts configured keys at any depth", func() {
+		redactKeys = map[string]bool{"password": true}
+		log.JSONMessage("CreateNetwork", map[string]interface{}{
+			"Options": map[string]interface{}{
+				"com.docker.network.generic": map[string]string{"Password": "hunter2", "mtu": "1500"},
+			},
+		})
+		Expect(out.String()).NotTo(ContainSubstring("hunter2"))
+		Expect(out.String()).To(ContainSubstring(redacted))
+		Expect(out.String()).To(ContainSubstring("1500"))
+	})
+})
@@ -0,0 +1,343 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	logger "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Subsystems whose log levels can be set independently.  The plugin subsystem
+// is the standard logrus logger, used by everything not covered by the others.
+const (
+	SubsystemPlugin    = "plugin"
+	SubsystemNetwork   = "network"
+	SubsystemIPAM      = "ipam"
+	SubsystemNetns     = "netns"
+	SubsystemDatastore = "datastore"
+)
+
+// TraceLevel is accepted wherever a level is parsed.  logrus has no trace
+// level, so it enables debug logging along with the extra messages logged by
+// Logger.Tracef.
+const TraceLevel = "trace"
+
+// Logger is the logrus logger for one subsystem.  Messages logged through it
+// carry a "subsystem" field.
+//
+// logrus reads its Level without synchronisation, so that is left at debug and
+// the subsystem's own level is kept in level instead, checked as each entry
+// is formatted.
+type Logger struct {
+	*logger.Logger
+	name  string
+	level int32
+	trace int32
+}
+
+var (
+	Plugin    = &Logger{Logger: logger.StandardLogger(), name: SubsystemPlugin, level: int32(logger.InfoLevel)}
+	Network   = newLogger(SubsystemNetwork)
+	IPAM      = newLogger(SubsystemIPAM)
+	Netns     = newLogger(SubsystemNetns)
+	Datastore = newLogger(SubsystemDatastore)
+
+	loggers = map[string]*Logger{
+		SubsystemPlugin:    Plugin,
+		SubsystemNetwork:   Network,
+		SubsystemIPAM:      IPAM,
+		SubsystemNetns:     Netns,
+		SubsystemDatastore: Datastore,
+	}
+
+	// Levels saved by ToggleDebug, to be restored by the next toggle.
+	toggleMutex   sync.Mutex
+	toggledLevels map[string]string
+)
+
+func init() {
+	logger.SetLevel(logger.DebugLevel)
+	logger.SetFormatter(&subsystemFormatter{logger: Plugin, formatter: &logger.TextFormatter{}})
+}
+
+func newLogger(name string) *Logger {
+	l := &Logger{Logger: logger.New(), name: name, level: int32(logger.InfoLevel)}
+	l.Level = logger.DebugLevel
+	l.Out = os.Stderr
+	l.Formatter = &subsystemFormatter{logger: l, subsystem: name, formatter: &logger.TextFormatter{}}
+	return l
+}
+
+// enabled reports whether messages at the given level are logged.
+func (l *Logger) enabled(level logger.Level) bool {
+	return logger.Level(atomic.LoadInt32(&l.level)) >= level
+}
+
+// Tracef logs a message at debug level if the logger is at trace level.
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	if atomic.LoadInt32(&l.trace) != 0 {
+		l.WithField("trace", true).Debugf(format, args...)
+	}
+}
+
+// GetLevel returns the logger's level, as accepted by SetLevel.
+func (l *Logger) GetLevel() string {
+	if atomic.LoadInt32(&l.trace) != 0 {
+		return TraceLevel
+	}
+	return logger.Level(atomic.LoadInt32(&l.level)).String()
+}
+
+// checkLevel checks that a level is accepted by SetLevel.
+func checkLevel(level string) error {
+	_, _, err := parseLevel(level)
+	return err
+}
+
+func parseLevel(level string) (logger.Level, bool, error) {
+	if level == TraceLevel {
+		return logger.DebugLevel, true, nil
+	}
+	parsed, err := logger.ParseLevel(level)
+	if err != nil {
+		return parsed, false, errors.Wrapf(err, "Log level %q parsing error", level)
+	}
+	return parsed, false, nil
+}
+
+func (l *Logger) setLevel(level string) error {
+	parsed, trace, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if trace {
+		atomic.StoreInt32(&l.trace, 1)
+	} else {
+		atomic.StoreInt32(&l.trace, 0)
+	}
+	atomic.StoreInt32(&l.level, int32(parsed))
+	return nil
+}
+
+// SetLevel sets the level of the named subsystem, or of every subsystem if
+// subsystem is empty.
+func SetLevel(subsystem, level string) error {
+	if subsystem == "" {
+		for _, l := range loggers {
+			if err := l.setLevel(level); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	l, ok := loggers[subsystem]
+	if !ok {
+		return errors.Errorf("Unknown log subsystem %q", subsystem)
+	}
+	return l.setLevel(level)
+}
+
+// Levels returns the level of each subsystem.
+func Levels() map[string]string {
+	levels := map[string]string{}
+	for name, l := range loggers {
+		levels[name] = l.GetLevel()
+	}
+	return levels
+}
+
+// ToggleDebug switches every subsystem to debug level, or back to the levels
+// they had before if it was called to switch them last.
+func ToggleDebug() {
+	toggleMutex.Lock()
+	defer toggleMutex.Unlock()
+
+	if toggledLevels != nil {
+		for name, level := range toggledLevels {
+			_ = SetLevel(name, level)
+		}
+		toggledLevels = nil
+		Plugin.Infoln("Restored log levels")
+		return
+	}
+
+	toggledLevels = Levels()
+	for name, level := range toggledLevels {
+		if level != TraceLevel {
+			_ = SetLevel(name, logger.DebugLevel.String())
+		}
+	}
+	Plugin.Infoln("Enabled debug logging")
+}
+
+// ParseSubsystemLevels parses a comma separated list of subsystem=level pairs,
+// e.g. "ipam=debug,netns=trace".
+func ParseSubsystemLevels(s string) (map[string]string, error) {
+	levels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid subsystem log level %q, expected subsystem=level", pair)
+		}
+		levels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return levels, nil
+}
+
+// Subsystems returns the names of the subsystems, sorted.
+func Subsystems() []string {
+	var names []string
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Config selects where logs are written and how much is logged.
+type Config struct {
+	// Level applies to every subsystem not listed in SubsystemLevels.
+	Level           string
+	SubsystemLevels map[string]string
+
+	// Format is "text" or "json".
+	Format string
+
+	// File, if set, is written to instead of stderr.  It is rotated when it
+	// reaches MaxSizeMB, keeping MaxBackups old files.
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+
+	// MaxJSONLength limits the length of the requests and responses logged at
+	// debug level, or is zero for no limit.  Values whose keys are in
+	// RedactKeys, compared case-insensitively, are never logged.
+	MaxJSONLength int
+	RedactKeys    []string
+}
+
+// Configure applies the config to every subsystem.  It should be called before
+// anything is logged by the other subsystems.
+func Configure(c Config) error {
+	var formatter logger.Formatter
+	switch c.Format {
+	case "", "text":
+		formatter = &logger.TextFormatter{}
+	case "json":
+		formatter = &logger.JSONFormatter{}
+	default:
+		return errors.Errorf("Unknown log format %q", c.Format)
+	}
+
+	var out io.Writer = os.Stderr
+	if c.File != "" {
+		file, err := OpenRotatingFile(c.File, int64(c.MaxSizeMB)*1024*1024, c.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	if err := Reconfigure(c); err != nil {
+		return err
+	}
+
+	for name, l := range loggers {
+		if name == SubsystemPlugin {
+			logger.SetOutput(out)
+			logger.SetFormatter(&subsystemFormatter{logger: l, formatter: formatter})
+			continue
+		}
+		l.Out = out
+		l.Formatter = &subsystemFormatter{logger: l, subsystem: name, formatter: formatter}
+	}
+	return nil
+}
+
+// Reconfigure applies the levels and payload settings of the config, which can
+// be changed while the plugin is running.  Nothing is changed if a level is
+// invalid.  The format and file are left as they are.
+func Reconfigure(c Config) error {
+	level := c.Level
+	if level == "" {
+		level = logger.InfoLevel.String()
+	}
+	levels := map[string]string{}
+	for name := range loggers {
+		levels[name] = level
+	}
+	for name, level := range c.SubsystemLevels {
+		if _, ok := loggers[name]; !ok {
+			return errors.Errorf("Unknown log subsystem %q", name)
+		}
+		levels[name] = level
+	}
+	for _, level := range levels {
+		if err := checkLevel(level); err != nil {
+			return err
+		}
+	}
+	for name, level := range levels {
+		if err := SetLevel(name, level); err != nil {
+			return err
+		}
+	}
+
+	keys := map[string]bool{}
+	for _, key := range c.RedactKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[strings.ToLower(key)] = true
+		}
+	}
+	payloadMutex.Lock()
+	defer payloadMutex.Unlock()
+	maxJSONLength = c.MaxJSONLength
+	redactKeys = keys
+	return nil
+}
+
+// subsystemFormatter drops the entries below the logger's level, which are
+// then written as nothing, and adds the subsystem, if any, to the rest before
+// formatting them.
+type subsystemFormatter struct {
+	logger    *Logger
+	subsystem string
+	formatter logger.Formatter
+}
+
+func (f *subsystemFormatter) Format(entry *logger.Entry) ([]byte, error) {
+	if !f.logger.enabled(entry.Level) {
+		return nil, nil
+	}
+	if f.subsystem == "" {
+		return f.formatter.Format(entry)
+	}
+	data := make(logger.Fields, len(entry.Data)+1)
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	data["subsystem"] = f.subsystem
+	withSubsystem := *entry
+	withSubsystem.Data = data
+	return f.formatter.Format(&withSubsystem)
+}
+
+// LevelsString describes the level of each subsystem, e.g. for logging at
+// startup.
+func LevelsString() string {
+	var parts []string
+	levels := Levels()
+	for _, name := range Subsystems() {
+		parts = append(parts, fmt.Sprintf("%v=%v", name, levels[name]))
+	}
+	return strings.Join(parts, ",")
+}
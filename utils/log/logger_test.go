@@ -0,0 +1,167 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Subsystem loggers", func() {
+	var out *bytes.Buffer
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		IPAM.Out = out
+		Expect(SetLevel("", "info")).To(Succeed())
+	})
+
+	AfterEach(func() {
+		IPAM.Out = os.Stderr
+		Expect(SetLevel("", "info")).To(Succeed())
+	})
+
+	It("sets levels per subsystem", func() {
+		Expect(SetLevel(SubsystemIPAM, "debug")).To(Succeed())
+		Expect(Levels()).To(HaveKeyWithValue(SubsystemIPAM, "debug"))
+		Expect(Levels()).To(HaveKeyWithValue(SubsystemNetwork, "info"))
+
+		IPAM.Debugf("visible")
+		Expect(out.String()).To(ContainSubstring("visible"))
+		Expect(out.String()).To(ContainSubstring("subsystem=ipam"))
+	})
+
+	It("rejects unknown subsystems and levels", func() {
+		Expect(SetLevel("dns", "debug")).NotTo(Succeed())
+		Expect(SetLevel(SubsystemIPAM, "loud")).NotTo(Succeed())
+	})
+
+	It("reconfigures levels and payloads, changing nothing if a level is invalid", func() {
+		defer func() {
+			maxJSONLength = DefaultMaxJSONLength
+			redactKeys = map[string]bool{}
+		}()
+		Expect(Reconfigure(Config{
+			Level:           "warning",
+			SubsystemLevels: map[string]string{SubsystemIPAM: "trace"},
+			MaxJSONLength:   100,
+			RedactKeys:      []string{" Password "},
+		})).To(Succeed())
+		Expect(Levels()).To(HaveKeyWithValue(SubsystemIPAM, "trace"))
+		Expect(Levels()).To(HaveKeyWithValue(SubsystemNetwork, "warning"))
+		Expect(maxJSONLength).To(Equal(100))
+		Expect(redactKeys).To(Equal(map[string]bool{"password": true}))
+
+		Expect(Reconfigure(Config{Level: "info", SubsystemLevels: map[string]string{SubsystemNetns: "loud"}})).NotTo(Succeed())
+		Expect(Reconfigure(Config{Level: "info", SubsystemLevels: map[string]string{"dns": "debug"}})).NotTo(Succeed())
+		Expect(Levels()).To(HaveKeyWithValue(SubsystemNetwork, "warning"))
+		Expect(maxJSONLength).To(Equal(100))
+	})
+
+	It("only logs trace messages at trace level", func() {
+		Expect(SetLevel(SubsystemIPAM, "debug")).To(Succeed())
+		IPAM.Tracef("hidden")
+		Expect(out.String()).To(BeEmpty())
+
+		Expect(SetLevel(SubsystemIPAM, TraceLevel)).To(Succeed())
+		Expect(IPAM.GetLevel()).To(Equal(TraceLevel))
+		IPAM.Tracef("shown")
+		Expect(out.String()).To(ContainSubstring("shown"))
+	})
+
+	It("toggles debug logging and back", func() {
+		Expect(SetLevel(SubsystemIPAM, "warning")).To(Succeed())
+		ToggleDebug()
+		Expect(IPAM.GetLevel()).To(Equal(logger.DebugLevel.String()))
+		ToggleDebug()
+		Expect(IPAM.GetLevel()).To(Equal("warning"))
+	})
+
+	It("changes levels while other goroutines are logging", func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				IPAM.WithField("i", i).Debugf("changing")
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			Expect(SetLevel(SubsystemIPAM, []string{"info", "debug"}[i%2])).To(Succeed())
+		}
+		<-done
+	})
+
+	It("doesn't log messages below the level", func() {
+		IPAM.Debugf("hidden")
+		IPAM.WithField("key", "value").Debugln("hidden")
+		Expect(out.String()).To(BeEmpty())
+
+		IPAM.Infof("shown")
+		Expect(out.String()).To(ContainSubstring("shown"))
+	})
+
+	It("parses subsystem levels", func() {
+		levels, err := ParseSubsystemLevels("ipam=debug, netns=trace")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(levels).To(Equal(map[string]string{"ipam": "debug", "netns": "trace"}))
+
+		_, err = ParseSubsystemLevels("ipam")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Rotating file", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "log")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "plugin.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("rotates at the maximum size, keeping the configured backups", func() {
+		f, err := OpenRotatingFile(path, 10, 2)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+			_, err := f.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("dddddddd\n")))
+		Expect(ioutil.ReadFile(path + ".1")).To(Equal([]byte("cccccccc\n")))
+		Expect(ioutil.ReadFile(path + ".2")).To(Equal([]byte("bbbbbbbb\n")))
+		_, err = os.Stat(path + ".3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("keeps writing to the current file if it can't be rotated", func() {
+		f, err := OpenRotatingFile(path, 10, 1)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		// A file can't be renamed over a directory that isn't empty.
+		Expect(os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755)).To(Succeed())
+		for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n"} {
+			_, err := f.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("aaaaaaaa\nbbbbbbbb\n")))
+
+		Expect(os.RemoveAll(path + ".1")).To(Succeed())
+		_, err = f.Write([]byte("cccccccc\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("cccccccc\n")))
+		Expect(ioutil.ReadFile(path + ".1")).To(Equal([]byte("aaaaaaaa\nbbbbbbbb\n")))
+	})
+})
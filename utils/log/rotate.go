@@ -0,0 +1,116 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RotatingFile is a log file that is rotated once it reaches a maximum size.
+// The current file is renamed to path.1, path.1 to path.2 and so on, keeping
+// at most maxBackups old files.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// OpenRotatingFile opens the file at path for appending.  A maxSize of zero
+// disables rotation.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return errors.Wrapf(err, "Log file %v opening error", f.path)
+	}
+	file, size, err := f.openFile()
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = size
+	return nil
+}
+
+func (f *RotatingFile) openFile() (*os.File, int64, error) {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Log file %v opening error", f.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrapf(err, "Log file %v opening error", f.path)
+	}
+	return file, info.Size(), nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// The current file is still open, so keep logging to it rather
+			// than losing messages.
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one.  The current file
+// is only closed once the new one is open, so if anything fails it is still
+// written to, under whichever name it then has.
+func (f *RotatingFile) rotate() error {
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(f.backupPath(i), f.backupPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "Log file %v rotation error", f.path)
+			}
+		}
+		if err := os.Rename(f.path, f.backupPath(1)); err != nil {
+			return errors.Wrapf(err, "Log file %v rotation error", f.path)
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return errors.Wrapf(err, "Log file %v rotation error", f.path)
+	}
+
+	file, size, err := f.openFile()
+	if err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Log file %v closing error", f.path))
+	}
+	f.file = file
+	f.size = size
+	return nil
+}
+
+func (f *RotatingFile) backupPath(i int) string {
+	return fmt.Sprintf("%v.%d", f.path, i)
+}
+
+// Close closes the current file.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
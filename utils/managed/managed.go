@@ -0,0 +1,127 @@
+package managed
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/pkg/errors"
+)
+
+const activatePath = "/Plugin.Activate"
+
+// Handler serves several plugin handlers on one listener.  A Docker managed
+// plugin has a single socket for all of the plugin types it implements, but
+// each plugin helper handler answers the activation request with only its own
+// type and can only be served on a listener of its own.
+//
+// So each helper handler is served on an in-memory listener, and the requests
+// for its plugin type, e.g. /NetworkDriver.Join, are forwarded to it.
+type Handler struct {
+	implements []string
+	listeners  []*pipeListener
+	proxies    map[string]http.Handler
+}
+
+// NewHandler creates a Handler for no plugin types.
+func NewHandler() *Handler {
+	return &Handler{proxies: map[string]http.Handler{}}
+}
+
+// Listener adds a plugin type, e.g. "NetworkDriver", returning the listener
+// that the helper handler for it must be served on.  Types must all be added
+// before serving.
+func (h *Handler) Listener(implements string) net.Listener {
+	l := newPipeListener(implements)
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: implements})
+	proxy.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return l.dial()
+		},
+	}
+	h.proxies[implements] = proxy
+	h.implements = append(h.implements, implements)
+	h.listeners = append(h.listeners, l)
+	return l
+}
+
+// Serve serves the plugin types added on the listener until it fails or is
+// closed, then closes the listeners of the helper handlers.
+func (h *Handler) Serve(l net.Listener) error {
+	err := http.Serve(l, h)
+	for _, pipe := range h.listeners {
+		pipe.Close()
+	}
+	return err
+}
+
+// ServeHTTP tells Docker every plugin type served when the plugin is
+// activated, and forwards each request for a plugin type, whose path is
+// /<type>.<method>, to its helper handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == activatePath {
+		w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+		json.NewEncoder(w).Encode(map[string][]string{"Implements": h.implements})
+		return
+	}
+	implements := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), ".", 2)[0]
+	if proxy, ok := h.proxies[implements]; ok {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// pipeListener is an in-memory listener, accepting the connections made by
+// dial.
+type pipeListener struct {
+	name   string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener(name string) *pipeListener {
+	return &pipeListener{name: name, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, errors.Errorf("Plugin %v isn't being served", l.name)
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.Errorf("Plugin %v listener closed", l.name)
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
@@ -0,0 +1,13 @@
+package managed
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestManaged(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Managed Suite")
+}
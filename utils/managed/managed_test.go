@@ -0,0 +1,96 @@
+package managed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		listener net.Listener
+		stopped  chan struct{}
+	)
+
+	// serve serves a handler that echoes its plugin type and the request path
+	// on each helper listener.
+	serve := func(h *Handler, implements ...string) {
+		for _, name := range implements {
+			l := h.Listener(name)
+			go http.Serve(l, http.HandlerFunc(func(name string) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					fmt.Fprintf(w, "%v %v %s", name, r.URL.Path, body)
+				}
+			}(name)))
+		}
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		stopped = make(chan struct{})
+		go func() {
+			h.Serve(listener)
+			close(stopped)
+		}()
+	}
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post("http://"+listener.Addr().String()+path, "application/json", strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(data)
+	}
+
+	AfterEach(func() {
+		listener.Close()
+		Eventually(stopped).Should(BeClosed())
+	})
+
+	It("tells Docker every plugin type it implements", func() {
+		serve(NewHandler(), "NetworkDriver", "IpamDriver")
+
+		status, body := post("/Plugin.Activate", "")
+		Expect(status).To(Equal(http.StatusOK))
+		var manifest map[string][]string
+		Expect(json.Unmarshal([]byte(body), &manifest)).To(Succeed())
+		Expect(manifest).To(Equal(map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}))
+	})
+
+	It("forwards requests to the handler of their plugin type", func() {
+		serve(NewHandler(), "NetworkDriver", "IpamDriver")
+
+		status, body := post("/NetworkDriver.Join", `{"NetworkID":"n1"}`)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(`NetworkDriver /NetworkDriver.Join {"NetworkID":"n1"}`))
+
+		status, body = post("/IpamDriver.RequestAddress", `{"PoolID":"p1"}`)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(`IpamDriver /IpamDriver.RequestAddress {"PoolID":"p1"}`))
+
+		status, _ = post("/VolumeDriver.Mount", "")
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("closes the helper listeners when it stops serving", func() {
+		h := NewHandler()
+		l := h.Listener("NetworkDriver")
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := l.Accept()
+			accepted <- err
+		}()
+		serve(h)
+
+		listener.Close()
+		Eventually(stopped).Should(BeClosed())
+		Eventually(accepted).Should(Receive(HaveOccurred()))
+	})
+})
@@ -1,57 +1,90 @@
 package netns
 
 import (
+	"context"
 	"net"
 
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
 )
 
-func CreateVeth(vethNameHost, vethNameNSTemp string) error {
+var log = logutils.Netns
+
+// traced makes a netlink call, tracing it as a step of the request.
+func traced(ctx context.Context, call string, f func() error) error {
+	_, span := traceutils.StartSpan(ctx, "netlink "+call, traceutils.KindClient)
+	err := f()
+	span.Finish(err)
+	return err
+}
+
+func CreateVeth(ctx context.Context, vethNameHost, vethNameNSTemp string) error {
+	log := log.WithContext(ctx)
+	log.Tracef("Creating veth pair %v/%v", vethNameHost, vethNameNSTemp)
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: vethNameHost,
 		},
 		PeerName: vethNameNSTemp,
 	}
-	if err := netlink.LinkAdd(veth); err != nil {
+	if err := traced(ctx, "LinkAdd", func() error { return netlink.LinkAdd(veth) }); err != nil {
 		return err
 	}
 
-	err := netlink.LinkSetUp(veth)
+	err := traced(ctx, "LinkSetUp", func() error { return netlink.LinkSetUp(veth) })
+	if err == nil {
+		log.Debugf("Created veth pair %v/%v", vethNameHost, vethNameNSTemp)
+	}
 	return err
 }
 
-func SetVethMac(vethNameHost, mac string) error {
+func SetVethMac(ctx context.Context, vethNameHost, mac string) error {
+	log := log.WithContext(ctx)
+	log.Tracef("Setting MAC of veth %v to %v", vethNameHost, mac)
 	addr, err := net.ParseMAC(mac)
 	if err != nil {
 		return errors.Wrap(err, "Veth setting error")
 	}
-	return netlink.LinkSetHardwareAddr(&netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: vethNameHost,
-		},
-	}, addr)
+	return traced(ctx, "LinkSetHardwareAddr", func() error {
+		return netlink.LinkSetHardwareAddr(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: vethNameHost,
+			},
+		}, addr)
+	})
 }
 
-func RemoveVeth(vethNameHost string) error {
-	if ok, err := IsVethExists(vethNameHost); err != nil {
+func RemoveVeth(ctx context.Context, vethNameHost string) error {
+	log := log.WithContext(ctx)
+	if ok, err := IsVethExists(ctx, vethNameHost); err != nil {
 		return errors.Wrap(err, "Veth removal error")
 	} else if !ok {
+		log.Tracef("Veth %v not found, nothing to remove", vethNameHost)
 		return nil
 	}
-	return netlink.LinkDel(&netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: vethNameHost,
-		},
+	log.Debugf("Removing veth %v", vethNameHost)
+	return traced(ctx, "LinkDel", func() error {
+		return netlink.LinkDel(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: vethNameHost,
+			},
+		})
 	})
 }
 
-func IsVethExists(vethHostName string) (bool, error) {
-	links, err := netlink.LinkList()
+func IsVethExists(ctx context.Context, vethHostName string) (bool, error) {
+	var links []netlink.Link
+	err := traced(ctx, "LinkList", func() (err error) {
+		links, err = netlink.LinkList()
+		return
+	})
 	if err != nil {
 		return false, errors.Wrap(err, "Veth existing check error")
 	}
+	log.WithContext(ctx).Tracef("Checking %v links for veth %v", len(links), vethHostName)
 	for _, link := range links {
 		if link.Attrs().Name == vethHostName {
 			return true, nil
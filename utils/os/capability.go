@@ -0,0 +1,43 @@
+package os
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultStatusFile describes this process, including its capabilities.
+const DefaultStatusFile = "/proc/self/status"
+
+// CapNetAdmin is the capability needed to create and configure interfaces.
+const CapNetAdmin = 12
+
+// HasCapability reports whether the process described by statusFile has the
+// given capability in its effective set.
+func HasCapability(statusFile string, capability uint) (bool, error) {
+	f, err := os.Open(statusFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "Process status %v reading error", statusFile)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+		caps, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return false, errors.Wrapf(err, "Effective capabilities %q parsing error", fields[1])
+		}
+		return caps&(1<<capability) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, errors.Wrapf(err, "Process status %v reading error", statusFile)
+	}
+	return false, errors.Errorf("Process status %v doesn't list the effective capabilities", statusFile)
+}
@@ -0,0 +1,53 @@
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HasCapability", func() {
+	var dir, file string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "capability")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "status")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(status string) {
+		Expect(ioutil.WriteFile(file, []byte(status), 0644)).To(Succeed())
+	}
+
+	It("reads the effective capabilities", func() {
+		write("Name:\tlibnetwork-plugin\nCapInh:\t0000000000000000\nCapEff:\t0000000000001000\n")
+		has, err := HasCapability(file, CapNetAdmin)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(has).To(BeTrue())
+
+		has, err = HasCapability(file, 21)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(has).To(BeFalse())
+	})
+
+	It("fails if the capabilities can't be read", func() {
+		_, err := HasCapability(file, CapNetAdmin)
+		Expect(err).To(MatchError(ContainSubstring("reading error")))
+
+		write("Name:\tlibnetwork-plugin\n")
+		_, err = HasCapability(file, CapNetAdmin)
+		Expect(err).To(MatchError(ContainSubstring("doesn't list the effective capabilities")))
+
+		write("CapEff:\tall\n")
+		_, err = HasCapability(file, CapNetAdmin)
+		Expect(err).To(MatchError(ContainSubstring("parsing error")))
+	})
+})
@@ -0,0 +1,53 @@
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	nodenameEnv = "NODENAME"
+	hostnameEnv = "HOSTNAME"
+)
+
+// DefaultNodenameFile is where calico/node writes the name it registered the
+// node under.
+const DefaultNodenameFile = "/var/lib/calico/nodename"
+
+// NodeName returns the name of this node, and where it came from, so that
+// endpoints are created on the same node that calico/node registered.  It is
+// the first of these that is set:
+//
+//  1. the configured name
+//  2. $NODENAME, as given to calico/node
+//  3. the contents of nodenameFile, written by calico/node
+//  4. $HOSTNAME
+//  5. the name of the host
+func NodeName(configured, nodenameFile string) (string, string, error) {
+	if configured != "" {
+		return configured, "configuration", nil
+	}
+	if name := os.Getenv(nodenameEnv); name != "" {
+		return name, "$" + nodenameEnv, nil
+	}
+	if nodenameFile != "" {
+		data, err := ioutil.ReadFile(nodenameFile)
+		if err != nil && !os.IsNotExist(err) {
+			return "", "", errors.Wrapf(err, "Node name file %v reading error", nodenameFile)
+		}
+		if name := strings.TrimSpace(string(data)); name != "" {
+			return name, nodenameFile, nil
+		}
+	}
+	if name := os.Getenv(hostnameEnv); name != "" {
+		return name, "$" + hostnameEnv, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", "", errors.Wrap(err, "Hostname fetching error")
+	}
+	return name, "hostname", nil
+}
@@ -0,0 +1,62 @@
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NodeName", func() {
+	var dir, file, hostname string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nodename")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "nodename")
+		Expect(ioutil.WriteFile(file, []byte("from-file\n"), 0644)).To(Succeed())
+
+		hostname = os.Getenv(hostnameEnv)
+		os.Setenv(nodenameEnv, "from-nodename")
+		os.Setenv(hostnameEnv, "from-hostname")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		os.Unsetenv(nodenameEnv)
+		os.Setenv(hostnameEnv, hostname)
+	})
+
+	expect := func(configured, nodenameFile, name, source string) {
+		n, s, err := NodeName(configured, nodenameFile)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		ExpectWithOffset(1, n).To(Equal(name))
+		ExpectWithOffset(1, s).To(Equal(source))
+	}
+
+	It("takes the first name that is set", func() {
+		expect("configured", file, "configured", "configuration")
+		expect("", file, "from-nodename", "$NODENAME")
+
+		os.Unsetenv(nodenameEnv)
+		expect("", file, "from-file", file)
+
+		Expect(ioutil.WriteFile(file, []byte(" \n"), 0644)).To(Succeed())
+		expect("", file, "from-hostname", "$HOSTNAME")
+		expect("", filepath.Join(dir, "missing"), "from-hostname", "$HOSTNAME")
+
+		os.Unsetenv(hostnameEnv)
+		name, err := os.Hostname()
+		Expect(err).NotTo(HaveOccurred())
+		expect("", "", name, "hostname")
+	})
+
+	It("fails if the node name file can't be read", func() {
+		os.Unsetenv(nodenameEnv)
+		_, _, err := NodeName("", dir)
+		Expect(err).To(MatchError(ContainSubstring("Node name file")))
+	})
+})
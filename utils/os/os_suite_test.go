@@ -0,0 +1,13 @@
+package os
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestOs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Os Suite")
+}
@@ -0,0 +1,257 @@
+package retry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// These are deliberately fixed, as the README says, since they only pace the
+// retries.
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 5 * time.Minute
+
+	// How often the queue is checked for operations that are due.
+	pollInterval = time.Second
+)
+
+// Operation is a failed operation waiting to be retried.  Kind selects the
+// Executor that performs it and Key identifies what it acts on, e.g. an
+// endpoint ID or an IP address.
+type Operation struct {
+	Kind        string            `json:"kind"`
+	Key         string            `json:"key"`
+	Args        map[string]string `json:"args,omitempty"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+// Executor performs an operation, returning an error if it should be retried.
+type Executor func(op Operation) error
+
+// Queue holds operations that failed, typically because the datastore was
+// unavailable, and retries them in the background with exponential backoff
+// until they succeed.  The queue is saved to disk whenever it changes so that
+// operations survive a restart of the plugin.
+type Queue struct {
+	path      string
+	mutex     sync.Mutex
+	ops       []Operation
+	executors map[string]Executor
+}
+
+// Open loads the queue saved at path, or starts an empty one if there isn't a
+// saved queue yet.
+func Open(path string) (*Queue, error) {
+	q := &Queue{path: path, executors: map[string]Executor{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Retry queue %v reading error", path)
+	}
+	if err := json.Unmarshal(data, &q.ops); err != nil {
+		return nil, errors.Wrapf(err, "Retry queue %v parsing error", path)
+	}
+	if len(q.ops) > 0 {
+		log.Infof("Loaded %v operations to retry from %v", len(q.ops), path)
+	}
+	return q, nil
+}
+
+// Register sets the executor for operations of the given kind.  Executors must
+// be registered before Run is called.
+func (q *Queue) Register(kind string, executor Executor) {
+	q.executors[kind] = executor
+}
+
+// Add queues an operation to be retried, replacing any queued operation of
+// the same kind and key.
+func (q *Queue) Add(kind, key string, args map[string]string, cause error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.remove(kind, key)
+	q.ops = append(q.ops, Operation{
+		Kind:        kind,
+		Key:         key,
+		Args:        args,
+		NextAttempt: time.Now().Add(minBackoff),
+		LastError:   cause.Error(),
+	})
+	if err := q.save(); err != nil {
+		q.remove(kind, key)
+		return err
+	}
+
+	log.Warnf("Queued %v %v for retry (%v operations queued): %v", kind, key, len(q.ops), cause)
+	return nil
+}
+
+// Remove drops any queued operation of the given kind and key, for example
+// because it has been superseded.
+func (q *Queue) Remove(kind, key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.remove(kind, key) {
+		if err := q.save(); err != nil {
+			log.Errorln(err)
+		}
+	}
+}
+
+// Queued reports whether op is still queued as it was when it was taken from
+// the queue, rather than removed or replaced since.  Executors that wait for a
+// lock check it once they hold it, since whatever removes the operation may
+// have held the lock meanwhile.
+func (q *Queue) Queued(op Operation) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.current(op) >= 0
+}
+
+// Len returns the number of operations waiting to be retried.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.ops)
+}
+
+// Operations returns a copy of the queued operations.
+func (q *Queue) Operations() []Operation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]Operation(nil), q.ops...)
+}
+
+// Run retries queued operations as they become due, until the stop channel
+// is closed.
+func (q *Queue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			q.retryDue()
+		}
+	}
+}
+
+func (q *Queue) retryDue() {
+	for _, op := range q.due() {
+		executor, ok := q.executors[op.Kind]
+		if !ok {
+			log.Errorf("No executor for %v %v, dropping it from the retry queue", op.Kind, op.Key)
+			q.Remove(op.Kind, op.Key)
+			continue
+		}
+
+		err := executor(op)
+		q.complete(op, err)
+	}
+}
+
+// due returns copies of the operations whose next attempt is due.
+func (q *Queue) due() []Operation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var due []Operation
+	now := time.Now()
+	for _, op := range q.ops {
+		if !op.NextAttempt.After(now) {
+			due = append(due, op)
+		}
+	}
+	return due
+}
+
+// complete records the result of an attempt, removing the operation if it
+// succeeded and scheduling the next attempt if not.  Operations that were
+// removed or replaced while the attempt was running are left alone.
+func (q *Queue) complete(op Operation, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i := q.current(op)
+	if i < 0 {
+		return
+	}
+
+	if err == nil {
+		q.remove(op.Kind, op.Key)
+		log.Infof("Retried %v %v successfully (%v operations queued)", op.Kind, op.Key, len(q.ops))
+	} else {
+		backoff := minBackoff << uint(op.Attempts)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		q.ops[i].Attempts++
+		q.ops[i].NextAttempt = time.Now().Add(backoff)
+		q.ops[i].LastError = err.Error()
+		log.Warnf("Retrying %v %v failed, next attempt in %v (%v operations queued): %v", op.Kind, op.Key, backoff, len(q.ops), err)
+	}
+
+	if err := q.save(); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// current returns the index of op if it is still queued unchanged, or -1.
+func (q *Queue) current(op Operation) int {
+	i := q.find(op.Kind, op.Key)
+	if i < 0 || !q.ops[i].NextAttempt.Equal(op.NextAttempt) {
+		return -1
+	}
+	return i
+}
+
+func (q *Queue) find(kind, key string) int {
+	for i, op := range q.ops {
+		if op.Kind == kind && op.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *Queue) remove(kind, key string) bool {
+	i := q.find(kind, key)
+	if i < 0 {
+		return false
+	}
+	q.ops = append(q.ops[:i], q.ops[i+1:]...)
+	return true
+}
+
+// save writes the queue to disk, replacing the previous copy atomically.
+func (q *Queue) save() error {
+	data, err := json.Marshal(q.ops)
+	if err != nil {
+		return errors.Wrap(err, "Retry queue encoding error")
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return errors.Wrapf(err, "Retry queue %v saving error", q.path)
+	}
+	tempPath := q.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return errors.Wrapf(err, "Retry queue %v saving error", q.path)
+	}
+	if err := os.Rename(tempPath, q.path); err != nil {
+		return errors.Wrapf(err, "Retry queue %v saving error", q.path)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package retry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Retry queue", func() {
+	var dir, path string
+	var q *Queue
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "retry")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "queue.json")
+		q, err = Open(path)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// makeDue brings forward the next attempt of every queued operation.
+	makeDue := func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		for i := range q.ops {
+			q.ops[i].NextAttempt = time.Now().Add(-time.Second)
+		}
+	}
+
+	It("keeps operations across a restart", func() {
+		Expect(q.Add("Kind", "key", map[string]string{"arg": "value"}, errors.New("failed"))).To(Succeed())
+
+		reopened, err := Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Len()).To(Equal(1))
+		Expect(reopened.ops[0].Args).To(Equal(map[string]string{"arg": "value"}))
+	})
+
+	It("replaces an operation with the same kind and key", func() {
+		Expect(q.Add("Kind", "key", nil, errors.New("failed"))).To(Succeed())
+		Expect(q.Add("Kind", "key", nil, errors.New("failed again"))).To(Succeed())
+		Expect(q.Add("Kind", "other", nil, errors.New("failed"))).To(Succeed())
+		Expect(q.Len()).To(Equal(2))
+
+		q.Remove("Kind", "key")
+		Expect(q.Len()).To(Equal(1))
+	})
+
+	It("reports whether an operation is still queued unchanged", func() {
+		Expect(q.Add("Kind", "key", nil, errors.New("failed"))).To(Succeed())
+		op := q.Operations()[0]
+		Expect(q.Queued(op)).To(BeTrue())
+
+		Expect(q.Add("Kind", "key", nil, errors.New("failed again"))).To(Succeed())
+		Expect(q.Queued(op)).To(BeFalse())
+		Expect(q.Queued(q.Operations()[0])).To(BeTrue())
+
+		q.Remove("Kind", "key")
+		Expect(q.Queued(op)).To(BeFalse())
+	})
+
+	It("backs off until the operation succeeds", func() {
+		attempts := 0
+		q.Register("Kind", func(op Operation) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("still failing")
+			}
+			return nil
+		})
+		Expect(q.Add("Kind", "key", nil, errors.New("failed"))).To(Succeed())
+
+		// Not due yet.
+		q.retryDue()
+		Expect(attempts).To(Equal(0))
+
+		makeDue()
+		q.retryDue()
+		Expect(attempts).To(Equal(1))
+		Expect(q.ops[0].Attempts).To(Equal(1))
+		Expect(q.ops[0].NextAttempt).To(BeTemporally(">", time.Now()))
+
+		makeDue()
+		q.retryDue()
+		makeDue()
+		q.retryDue()
+		Expect(attempts).To(Equal(3))
+		Expect(q.Len()).To(Equal(0))
+
+		reopened, err := Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Len()).To(Equal(0))
+	})
+})
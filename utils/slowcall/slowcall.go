@@ -0,0 +1,231 @@
+package slowcall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	logutils "github.com/projectcalico/libnetwork-plugin/utils/log"
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
+)
+
+const (
+	// How many of the most recent calls are kept for the summary.
+	maxRecent = 1000
+
+	// How many requests can have finished steps while still in progress
+	// themselves.  Steps of any more aren't broken down.
+	maxPending = 10000
+)
+
+// Step is one step of a driver method call, such as a datastore operation.
+type Step struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+
+	duration time.Duration
+}
+
+// Call is a finished driver method call.
+type Call struct {
+	Method        string    `json:"method"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	Started       time.Time `json:"started"`
+	Seconds       float64   `json:"seconds"`
+	Error         string    `json:"error,omitempty"`
+	Steps         []Step    `json:"steps"`
+
+	duration time.Duration
+}
+
+// Detector times each driver method call from its trace spans, warning about
+// the calls that take longer than their threshold, with a breakdown of the
+// time taken by each step.  It keeps the most recent calls so that the slowest
+// of them can be shown.
+type Detector struct {
+	mutex      sync.Mutex
+	threshold  time.Duration
+	thresholds map[string]time.Duration
+	pending    map[string][]*traceutils.Span
+	recent     []Call
+	next       int
+}
+
+// NewDetector creates a detector that warns about calls that take longer than
+// threshold, or the threshold for the method in thresholds if there is one.
+// Methods are named like their spans, e.g. network.Join.  A threshold of 0
+// disables the warnings.
+func NewDetector(threshold time.Duration, thresholds map[string]time.Duration) *Detector {
+	return &Detector{
+		threshold:  threshold,
+		thresholds: thresholds,
+		pending:    map[string][]*traceutils.Span{},
+	}
+}
+
+// SetThresholds replaces the thresholds, as given to NewDetector.
+func (d *Detector) SetThresholds(threshold time.Duration, thresholds map[string]time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.threshold = threshold
+	d.thresholds = thresholds
+}
+
+// ParseThresholds parses per-method thresholds given as a comma separated
+// list of method=duration pairs, e.g. "network.Join=5s,ipam.RequestAddress=2s".
+func ParseThresholds(s string) (map[string]time.Duration, error) {
+	thresholds := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid slow call threshold %q, expected method=duration", pair)
+		}
+		threshold, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid slow call threshold %q", pair)
+		}
+		thresholds[strings.TrimSpace(parts[0])] = threshold
+	}
+	return thresholds, nil
+}
+
+// Export receives each span as it ends.  The steps of a call end before the
+// call itself, so they are held until it does.
+func (d *Detector) Export(span *traceutils.Span) {
+	d.mutex.Lock()
+	if span.ParentSpanID != "" {
+		if _, ok := d.pending[span.TraceID]; ok || len(d.pending) < maxPending {
+			d.pending[span.TraceID] = append(d.pending[span.TraceID], span)
+		}
+		d.mutex.Unlock()
+		return
+	}
+	steps := d.pending[span.TraceID]
+	delete(d.pending, span.TraceID)
+	threshold, ok := d.thresholds[span.Name]
+	if !ok {
+		threshold = d.threshold
+	}
+	d.mutex.Unlock()
+
+	// Only the spans of requests from Docker are driver method calls.
+	if span.Kind != traceutils.KindServer {
+		return
+	}
+	call := newCall(span, steps)
+	d.record(call)
+
+	if threshold > 0 && call.duration > threshold {
+		log.WithFields(log.Fields{
+			"method":                    call.Method,
+			"duration":                  call.duration.String(),
+			"threshold":                 threshold.String(),
+			"steps":                     formatSteps(call.Steps),
+			logutils.CorrelationIDField: call.CorrelationID,
+		}).Warnf("Slow %v call took %v, over the %v threshold", call.Method, call.duration, threshold)
+	}
+}
+
+func newCall(span *traceutils.Span, steps []*traceutils.Span) Call {
+	sort.Sort(byStart(steps))
+	call := Call{
+		Method:        span.Name,
+		CorrelationID: span.Attribute(logutils.CorrelationIDField),
+		Started:       span.Start,
+		Steps:         make([]Step, 0, len(steps)),
+		duration:      span.Duration(),
+	}
+	call.Seconds = call.duration.Seconds()
+	if span.Err != nil {
+		call.Error = span.Err.Error()
+	}
+	for _, s := range steps {
+		step := Step{Name: s.Name, duration: s.Duration()}
+		step.Seconds = step.duration.Seconds()
+		if s.Err != nil {
+			step.Error = s.Err.Error()
+		}
+		call.Steps = append(call.Steps, step)
+	}
+	return call
+}
+
+type byStart []*traceutils.Span
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+
+// formatSteps lists the steps and their durations on one line, for logging.
+func formatSteps(steps []Step) string {
+	var parts []string
+	for _, step := range steps {
+		parts = append(parts, fmt.Sprintf("%v=%v", step.Name, step.duration))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (d *Detector) record(call Call) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.recent) < maxRecent {
+		d.recent = append(d.recent, call)
+		return
+	}
+	d.recent[d.next] = call
+	d.next = (d.next + 1) % maxRecent
+}
+
+// Slowest returns the n slowest of the most recent calls, slowest first.
+func (d *Detector) Slowest(n int) []Call {
+	d.mutex.Lock()
+	calls := make([]Call, len(d.recent))
+	copy(calls, d.recent)
+	d.mutex.Unlock()
+
+	sort.Sort(bySlowest(calls))
+	if len(calls) > n {
+		calls = calls[:n]
+	}
+	return calls
+}
+
+// Handler serves the n slowest of the most recent calls as JSON, or as many
+// as the "n" parameter asks for.
+func (d *Detector) Handler(n int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shown := n
+		if param := r.FormValue("n"); param != "" {
+			var err error
+			if shown, err = strconv.Atoi(param); err != nil || shown < 0 {
+				http.Error(w, fmt.Sprintf("Invalid number of calls %q", param), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(d.Slowest(shown)); err != nil {
+			log.Errorln(errors.Wrap(err, "Slowest calls encoding error"))
+		}
+	})
+}
+
+type bySlowest []Call
+
+func (c bySlowest) Len() int           { return len(c) }
+func (c bySlowest) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c bySlowest) Less(i, j int) bool { return c[i].duration > c[j].duration }
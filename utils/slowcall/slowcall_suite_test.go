@@ -0,0 +1,13 @@
+package slowcall
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSlowCall(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Slow Call Suite")
+}
@@ -0,0 +1,142 @@
+package slowcall
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	traceutils "github.com/projectcalico/libnetwork-plugin/utils/trace"
+)
+
+var _ = Describe("Slow call detector", func() {
+	var output bytes.Buffer
+	var d *Detector
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		output.Reset()
+		log.SetOutput(&output)
+		d = NewDetector(time.Second, map[string]time.Duration{"ipam.RequestAddress": 100 * time.Millisecond})
+	})
+
+	// call exports the spans of a call that took the given time, with one
+	// step that took half of it.
+	call := func(traceID, method string, took time.Duration) {
+		step := &traceutils.Span{
+			TraceID:      traceID,
+			ParentSpanID: "parent",
+			Name:         "datastore IP auto assignment",
+			Kind:         traceutils.KindClient,
+			Start:        start,
+			End:          start.Add(took / 2),
+			Err:          errors.New("etcd unavailable"),
+		}
+		root := &traceutils.Span{
+			TraceID:    traceID,
+			SpanID:     "parent",
+			Name:       method,
+			Kind:       traceutils.KindServer,
+			Start:      start,
+			End:        start.Add(took),
+			Attributes: map[string]string{"correlation_id": traceID},
+		}
+		d.Export(step)
+		d.Export(root)
+	}
+
+	It("doesn't warn about calls within their threshold", func() {
+		call("t1", "network.Join", 500*time.Millisecond)
+		Expect(output.String()).To(BeEmpty())
+	})
+
+	It("warns about calls over their threshold with a breakdown of their steps", func() {
+		call("t1", "ipam.RequestAddress", 200*time.Millisecond)
+		Expect(output.String()).To(ContainSubstring("Slow ipam.RequestAddress call took 200ms, over the 100ms threshold"))
+		Expect(output.String()).To(ContainSubstring(`steps="datastore IP auto assignment=100ms"`))
+		Expect(output.String()).To(ContainSubstring("correlation_id=t1"))
+	})
+
+	It("never warns with a threshold of 0", func() {
+		d = NewDetector(0, nil)
+		call("t1", "network.Join", time.Hour)
+		Expect(output.String()).To(BeEmpty())
+	})
+
+	It("uses thresholds set while running", func() {
+		d.SetThresholds(time.Hour, map[string]time.Duration{"network.Join": 100 * time.Millisecond})
+		call("t1", "ipam.RequestAddress", 200*time.Millisecond)
+		Expect(output.String()).To(BeEmpty())
+		call("t2", "network.Join", 200*time.Millisecond)
+		Expect(output.String()).To(ContainSubstring("Slow network.Join call took 200ms, over the 100ms threshold"))
+	})
+
+	It("shows the slowest recent calls, slowest first", func() {
+		call("t1", "network.Join", 1*time.Millisecond)
+		call("t2", "network.Join", 3*time.Millisecond)
+		call("t3", "network.Leave", 2*time.Millisecond)
+
+		slowest := d.Slowest(2)
+		Expect(slowest).To(HaveLen(2))
+		Expect(slowest[0].CorrelationID).To(Equal("t2"))
+		Expect(slowest[0].Steps).To(Equal([]Step{{
+			Name:     "datastore IP auto assignment",
+			Seconds:  0.0015,
+			Error:    "etcd unavailable",
+			duration: 1500 * time.Microsecond,
+		}}))
+		Expect(slowest[1].CorrelationID).To(Equal("t3"))
+		Expect(d.pending).To(BeEmpty())
+	})
+
+	It("serves the slowest recent calls", func() {
+		call("t1", "network.Join", 1*time.Millisecond)
+		call("t2", "network.Join", 3*time.Millisecond)
+
+		get := func(url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			d.Handler(1).ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+			return w
+		}
+
+		var calls []Call
+		w := get("/slowcalls")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(w.Body.Bytes(), &calls)).To(Succeed())
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].CorrelationID).To(Equal("t2"))
+
+		Expect(json.Unmarshal(get("/slowcalls?n=5").Body.Bytes(), &calls)).To(Succeed())
+		Expect(calls).To(HaveLen(2))
+
+		Expect(get("/slowcalls?n=many").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("only keeps the most recent calls", func() {
+		call("slow", "network.Join", time.Hour)
+		for i := 0; i < maxRecent; i++ {
+			call("fast", "network.Join", time.Millisecond)
+		}
+		Expect(d.Slowest(1)[0].CorrelationID).To(Equal("fast"))
+	})
+
+	It("parses per-method thresholds", func() {
+		thresholds, err := ParseThresholds(" network.Join=5s, ipam.RequestAddress=250ms ,")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(thresholds).To(Equal(map[string]time.Duration{
+			"network.Join":        5 * time.Second,
+			"ipam.RequestAddress": 250 * time.Millisecond,
+		}))
+
+		_, err = ParseThresholds("network.Join")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseThresholds("network.Join=soon")
+		Expect(err).To(HaveOccurred())
+	})
+})
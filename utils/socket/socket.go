@@ -0,0 +1,127 @@
+package socket
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time allowed for connecting to an existing socket to see if it's in use.
+const dialTimeout = time.Second
+
+// groupFile lists the groups that sockets can be owned by.
+var groupFile = "/etc/group"
+
+// Listener is a plugin socket, which holds a lock on its path until it is
+// closed so that no other instance can serve on it.
+type Listener struct {
+	net.Listener
+	lock *os.File
+}
+
+// Listen creates the unix socket that a plugin is served on, at dir/name.sock,
+// readable and writable by its owner and group.
+//
+// The socket is locked, using dir/name.lock, so that two instances of the
+// plugin can't claim the same socket.  A socket left behind by an instance
+// that has stopped is replaced.
+func Listen(dir, name, group string) (*Listener, error) {
+	path := filepath.Join(dir, name+".sock")
+	gid, err := lookupGID(group)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Plugin socket directory %v creation error", dir)
+	}
+
+	lockPath := filepath.Join(dir, name+".lock")
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Plugin socket lock %v opening error", lockPath)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("Plugin socket %v is already being served by another instance", path)
+		}
+		return nil, errors.Wrapf(err, "Plugin socket lock %v locking error", lockPath)
+	}
+
+	// Instances from before sockets were locked don't take the lock, so
+	// check that nothing is still serving on the socket before replacing it.
+	if conn, err := net.DialTimeout("unix", path, dialTimeout); err == nil {
+		conn.Close()
+		lock.Close()
+		return nil, errors.Errorf("Plugin socket %v is already being served by another instance", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		lock.Close()
+		return nil, errors.Wrapf(err, "Plugin socket %v removal error", path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "Plugin socket %v listening error", path)
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		l.Close()
+		lock.Close()
+		return nil, errors.Wrapf(err, "Plugin socket %v ownership error", path)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		lock.Close()
+		return nil, errors.Wrapf(err, "Plugin socket %v permissions error", path)
+	}
+	return &Listener{Listener: l, lock: lock}, nil
+}
+
+// Close stops serving on the socket, removing it, and releases its lock.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	if lockErr := l.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// lookupGID returns the ID of a group given by name or ID.  Groups are looked
+// up in the group file, since the plugin is built without cgo.
+func lookupGID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	f, err := os.Open(groupFile)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Group %v lookup error", group)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is name:password:gid:members.
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != group {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, errors.Wrapf(err, "Group %v lookup error", group)
+		}
+		return gid, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrapf(err, "Group %v lookup error", group)
+	}
+	return 0, errors.Errorf("Group %v lookup error: no such group in %v", group, groupFile)
+}
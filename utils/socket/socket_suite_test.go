@@ -0,0 +1,13 @@
+package socket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSocket(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Socket Suite")
+}
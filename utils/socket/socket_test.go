@@ -0,0 +1,95 @@
+package socket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plugin socket", func() {
+	var dir, group string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "socket")
+		Expect(err).NotTo(HaveOccurred())
+		group = strconv.Itoa(os.Getgid())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("serves on dir/name.sock, readable and writable by its group", func() {
+		l, err := Listen(dir, "calico", group)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+
+		info, err := os.Stat(filepath.Join(dir, "calico.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+		conn, err := net.Dial("unix", filepath.Join(dir, "calico.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		conn.Close()
+	})
+
+	It("refuses a socket that another instance is serving on", func() {
+		l, err := Listen(dir, "calico", group)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+
+		_, err = Listen(dir, "calico", group)
+		Expect(err).To(MatchError(ContainSubstring("already being served by another instance")))
+
+		// Other names can still be served.
+		other, err := Listen(dir, "calico-ipam", group)
+		Expect(err).NotTo(HaveOccurred())
+		other.Close()
+	})
+
+	It("refuses a socket that an instance without the lock is serving on", func() {
+		l, err := net.Listen("unix", filepath.Join(dir, "calico.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+
+		_, err = Listen(dir, "calico", group)
+		Expect(err).To(MatchError(ContainSubstring("already being served by another instance")))
+	})
+
+	It("replaces a socket left behind by an instance that has stopped", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "calico.sock"), nil, 0600)).To(Succeed())
+
+		l, err := Listen(dir, "calico", group)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Close()).To(Succeed())
+
+		// Once closed, the socket can be claimed again.
+		l, err = Listen(dir, "calico", group)
+		Expect(err).NotTo(HaveOccurred())
+		l.Close()
+	})
+
+	Describe("group lookup", func() {
+		BeforeEach(func() {
+			groupFile = filepath.Join(dir, "group")
+			Expect(ioutil.WriteFile(groupFile, []byte("root:x:0:\ndocker:x:999:alice,bob\n"), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			groupFile = "/etc/group"
+		})
+
+		It("looks groups up by name or ID", func() {
+			Expect(lookupGID("docker")).To(Equal(999))
+			Expect(lookupGID("42")).To(Equal(42))
+			_, err := lookupGID("nobody")
+			Expect(err).To(MatchError(ContainSubstring("no such group")))
+		})
+	})
+})
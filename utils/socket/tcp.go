@@ -0,0 +1,99 @@
+package socket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ListenTLS listens on a TCP address with mutual TLS: clients must present a
+// certificate signed by the CA in clientCAFile.
+func ListenTLS(addr, certFile, keyFile, clientCAFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "TLS certificate %v loading error", certFile)
+	}
+	ca, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "TLS client CA %v reading error", clientCAFile)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.Errorf("TLS client CA %v parsing error: no PEM certificates found", clientCAFile)
+	}
+
+	l, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Plugin address %v listening error", addr)
+	}
+	return l, nil
+}
+
+// Spec is a Docker plugin discovery file, which tells Docker the address of a
+// plugin that isn't served on a socket in its plugin directory.
+type Spec struct {
+	Name      string   `json:"Name"`
+	Addr      string   `json:"Addr"`
+	TLSConfig *SpecTLS `json:"TLSConfig,omitempty"`
+}
+
+// SpecTLS holds the files, as Docker sees them, that Docker uses to verify
+// the plugin and to identify itself to it.
+type SpecTLS struct {
+	CAFile             string `json:"CAFile"`
+	CertFile           string `json:"CertFile"`
+	KeyFile            string `json:"KeyFile"`
+	InsecureSkipVerify bool   `json:"InsecureSkipVerify"`
+}
+
+// SpecAddr returns the address Docker should use to reach a plugin listening
+// with TLS on listenAddr: at host if one is given, otherwise at the listening
+// host, or localhost if it listens on every interface.
+func SpecAddr(listenAddr, host string) (string, error) {
+	listenHost, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", errors.Wrapf(err, "Plugin address %v parsing error", listenAddr)
+	}
+	if host == "" {
+		host = listenHost
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+	}
+	return "https://" + net.JoinHostPort(host, port), nil
+}
+
+// WriteSpec writes the discovery file for a plugin to dir/name.json, returning
+// its path.
+func WriteSpec(dir string, spec Spec) (string, error) {
+	path := filepath.Join(dir, spec.Name+".json")
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", errors.Wrapf(err, "Plugin spec %v encoding error", path)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrapf(err, "Plugin spec directory %v creation error", dir)
+	}
+
+	// Docker may read the file at any time, so replace it in one step.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return "", errors.Wrapf(err, "Plugin spec %v writing error", path)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrapf(err, "Plugin spec %v writing error", path)
+	}
+	return path, nil
+}
@@ -0,0 +1,162 @@
+package socket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// certificate is a key pair, signed by its parent if it has one.
+type certificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCertificate(name string, parent *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &certificate{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files in dir.
+func (c *certificate) write(dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)).To(Succeed())
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+var _ = Describe("TCP with mutual TLS", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tcp")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("only accepts clients with a certificate signed by the client CA", func() {
+		ca := newCertificate("ca", nil)
+		caFile, _ := ca.write(dir, "ca")
+		certFile, keyFile := newCertificate("plugin", ca).write(dir, "plugin")
+
+		l, err := ListenTLS("127.0.0.1:0", certFile, keyFile, caFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		dial := func(client *certificate) error {
+			config := &tls.Config{RootCAs: roots}
+			if client != nil {
+				config.Certificates = []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+			}
+			conn, err := tls.Dial("tcp", l.Addr().String(), config)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			// The server only rejects the client's certificate after the
+			// client has finished its side of the handshake.
+			_, err = conn.Read(make([]byte, 1))
+			return err
+		}
+
+		Expect(dial(newCertificate("docker", ca))).NotTo(MatchError(ContainSubstring("certificate")))
+		Expect(dial(nil)).To(HaveOccurred())
+		Expect(dial(newCertificate("other", newCertificate("other-ca", nil)))).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("rejects a client CA file without certificates", func() {
+		ca := newCertificate("ca", nil)
+		certFile, keyFile := newCertificate("plugin", ca).write(dir, "plugin")
+		Expect(ioutil.WriteFile(filepath.Join(dir, "empty.crt"), nil, 0600)).To(Succeed())
+
+		_, err := ListenTLS("127.0.0.1:0", certFile, keyFile, filepath.Join(dir, "empty.crt"))
+		Expect(err).To(MatchError(ContainSubstring("no PEM certificates found")))
+	})
+
+	It("advertises the address Docker should connect to", func() {
+		Expect(SpecAddr("10.0.0.1:9200", "")).To(Equal("https://10.0.0.1:9200"))
+		Expect(SpecAddr(":9200", "")).To(Equal("https://localhost:9200"))
+		Expect(SpecAddr("0.0.0.0:9200", "")).To(Equal("https://localhost:9200"))
+		Expect(SpecAddr(":9200", "plugin.example.com")).To(Equal("https://plugin.example.com:9200"))
+		_, err := SpecAddr("9200", "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes discovery files in Docker's format", func() {
+		path, err := WriteSpec(filepath.Join(dir, "plugins"), Spec{
+			Name:      "calico",
+			Addr:      "https://localhost:9200",
+			TLSConfig: &SpecTLS{CAFile: "/ca.crt", CertFile: "/docker.crt", KeyFile: "/docker.key"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, "plugins", "calico.json")))
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var spec map[string]interface{}
+		Expect(json.Unmarshal(data, &spec)).To(Succeed())
+		Expect(spec).To(Equal(map[string]interface{}{
+			"Name": "calico",
+			"Addr": "https://localhost:9200",
+			"TLSConfig": map[string]interface{}{
+				"CAFile":             "/ca.crt",
+				"CertFile":           "/docker.crt",
+				"KeyFile":            "/docker.key",
+				"InsecureSkipVerify": false,
+			},
+		}))
+	})
+})
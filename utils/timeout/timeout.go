@@ -0,0 +1,108 @@
+package timeout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Error is returned when a step of an RPC doesn't complete before the RPC's
+// deadline.  Step names the operation that was being waited for.
+type Error struct {
+	Step string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("Timed out waiting for %v", e.Step)
+}
+
+// IsTimeout reports whether err, or the error it wraps, is a timeout Error.
+func IsTimeout(err error) bool {
+	_, ok := errors.Cause(err).(Error)
+	return ok
+}
+
+// maxLate bounds the calls left running after their deadline passed, so that
+// a hung dependency can't pile up goroutines without limit.  Once it's
+// reached, further calls fail straight away until some of them finish.
+const maxLate = 64
+
+var lateCalls int32
+
+// Run calls f, returning an Error for step if the context expires before f
+// returns.  f can't be interrupted, so it carries on in the background and its
+// result is discarded.
+func Run(ctx context.Context, step string, f func() error) error {
+	return RunLate(ctx, step, f, nil)
+}
+
+// RunLate calls f like Run, but if the context expires before f returns, late
+// is called with the result of f once it does, e.g. to undo a change that has
+// been reported as failed.  If f isn't called at all, because the context has
+// already expired or too many earlier calls are still running, late is called
+// straight away with the Error returned.  late may be nil.
+func RunLate(ctx context.Context, step string, f func() error, late func(err error)) error {
+	if ctx.Err() != nil {
+		return notStarted(Check(ctx, step, ctx.Err()), late)
+	}
+	if atomic.LoadInt32(&lateCalls) >= maxLate {
+		return notStarted(Error{Step: step}, late)
+	}
+
+	// Whichever of f returning and the context expiring comes first decides
+	// whether the result of f is returned or passed to late.
+	var mutex sync.Mutex
+	var finished, abandoned bool
+	var result error
+	done := make(chan struct{})
+	go func() {
+		err := f()
+		mutex.Lock()
+		finished, result = true, err
+		wasAbandoned := abandoned
+		mutex.Unlock()
+		close(done)
+
+		if wasAbandoned {
+			if late != nil {
+				late(err)
+			}
+			atomic.AddInt32(&lateCalls, -1)
+		}
+	}()
+
+	select {
+	case <-done:
+		return result
+	case <-ctx.Done():
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if finished {
+		return result
+	}
+	abandoned = true
+	atomic.AddInt32(&lateCalls, 1)
+	return Check(ctx, step, ctx.Err())
+}
+
+// notStarted passes err, for a call that wasn't made, to late.
+func notStarted(err error, late func(err error)) error {
+	if late != nil {
+		late(err)
+	}
+	return err
+}
+
+// Check converts the error from a context-aware call into an Error for step if
+// the call failed because the context's deadline passed.
+func Check(ctx context.Context, step string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return Error{Step: step}
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package timeout
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("RunLate", func() {
+	// lateResults receives the results passed to late.
+	var lateResults chan error
+
+	BeforeEach(func() {
+		lateResults = make(chan error, maxLate+1)
+	})
+
+	late := func(err error) {
+		lateResults <- err
+	}
+
+	It("returns the result of calls that finish in time", func() {
+		err := RunLate(context.Background(), "step", func() error { return errors.New("failed") }, late)
+		Expect(err).To(MatchError("failed"))
+		Consistently(lateResults).ShouldNot(Receive())
+	})
+
+	It("passes the result of calls that finish after the deadline to late", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		release := make(chan struct{})
+		err := RunLate(ctx, "step", func() error {
+			<-release
+			return nil
+		}, late)
+		Expect(err).To(Equal(Error{Step: "step"}))
+
+		close(release)
+		Eventually(lateResults).Should(Receive(BeNil()))
+	})
+
+	It("doesn't start calls once too many are late", func() {
+		release := make(chan struct{})
+		for i := 0; i < maxLate; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			Expect(RunLate(ctx, "step", func() error {
+				<-release
+				return nil
+			}, nil)).To(Equal(Error{Step: "step"}))
+			cancel()
+		}
+
+		started := false
+		err := RunLate(context.Background(), "step", func() error {
+			started = true
+			return nil
+		}, late)
+		Expect(err).To(Equal(Error{Step: "step"}))
+		Expect(started).To(BeFalse())
+		Expect(lateResults).To(Receive(Equal(Error{Step: "step"})))
+
+		close(release)
+		Eventually(func() error { return Run(context.Background(), "step", func() error { return nil }) }).Should(Succeed())
+	})
+})
@@ -0,0 +1,219 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	serviceName = "calico-libnetwork-plugin"
+	scopeName   = "github.com/projectcalico/libnetwork-plugin"
+
+	// How often spans are sent, and how many are held before new ones are
+	// dropped if they can't be sent.
+	flushInterval = time.Second
+	maxQueued     = 10000
+
+	httpTimeout = 10 * time.Second
+)
+
+// OTLPExporter batches spans and sends them as OTLP/JSON
+// ExportTraceServiceRequests, either appended to a file one per line or
+// posted to a collector.
+type OTLPExporter struct {
+	mutex   sync.Mutex
+	spans   []*Span
+	dropped int
+
+	send func(data []byte) error
+}
+
+// NewFileExporter appends spans to the file at path.
+func NewFileExporter(path string) (*OTLPExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "Trace file %v opening error", path)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Trace file %v opening error", path)
+	}
+	return &OTLPExporter{send: func(data []byte) error {
+		_, err := file.Write(append(data, '\n'))
+		return errors.Wrapf(err, "Trace file %v writing error", path)
+	}}, nil
+}
+
+// NewHTTPExporter posts spans to an OTLP/HTTP collector, e.g.
+// http://localhost:4318/v1/traces.
+func NewHTTPExporter(url string) *OTLPExporter {
+	client := &http.Client{Timeout: httpTimeout}
+	return &OTLPExporter{send: func(data []byte) error {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return errors.Wrapf(err, "Trace collector %v sending error", url)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.Errorf("Trace collector %v sending error: %v", url, resp.Status)
+		}
+		return nil
+	}}
+}
+
+// Export queues a span to be sent.  It never blocks on sending.
+func (e *OTLPExporter) Export(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.spans) >= maxQueued {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, span)
+}
+
+// Run sends queued spans periodically until the stop channel is closed, then
+// sends any that remain.
+func (e *OTLPExporter) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *OTLPExporter) flush() {
+	e.mutex.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.mutex.Unlock()
+
+	if dropped > 0 {
+		log.Warnf("Dropped %v trace spans that couldn't be sent in time", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(encodeRequest(spans))
+	if err != nil {
+		log.Errorln(errors.Wrap(err, "Trace spans encoding error"))
+		return
+	}
+	if err := e.send(data); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest.  IDs are hex
+// strings and times are decimal strings of nanoseconds since the epoch.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const statusCodeError = 2
+
+func encodeRequest(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, encodeSpan(span))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: encoded}},
+	}}}
+}
+
+func encodeSpan(span *Span) otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	encoded := otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+
+	// Sort the attributes so the output is stable.
+	var keys []string
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		encoded.Attributes = append(encoded.Attributes, attribute(key, span.Attributes[key]))
+	}
+
+	if span.Err != nil {
+		encoded.Status = otlpStatus{Code: statusCodeError, Message: span.Err.Error()}
+	}
+	return encoded
+}
+
+func attribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
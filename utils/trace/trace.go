@@ -0,0 +1,149 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Kinds of span, as defined by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span times one step of handling a request.  Spans are only recorded while
+// an exporter is set; otherwise StartSpan returns a nil Span, whose methods
+// do nothing.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Err          error
+
+	mutex sync.Mutex
+}
+
+type spanKey struct{}
+
+var (
+	exporterMutex sync.RWMutex
+	exporter      Exporter
+)
+
+// Exporter receives spans as they end.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Exporters sends each span to every one of its exporters.
+type Exporters []Exporter
+
+func (e Exporters) Export(span *Span) {
+	for _, exporter := range e {
+		exporter.Export(span)
+	}
+}
+
+// SetExporter sets the exporter that spans are sent to, or disables tracing
+// if it is nil.
+func SetExporter(e Exporter) {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+	return exporter
+}
+
+// StartSpan starts a span, as a child of the span carried by the context if
+// there is one, and returns a context carrying the new span.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if currentExporter() == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute records a detail of the step, such as the ID of the object it
+// acted on.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Attributes[key] = value
+}
+
+// Attribute returns the value of an attribute, or "" if it isn't set.
+func (s *Span) Attribute(key string) string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Attributes[key]
+}
+
+// Duration returns how long the span took, once it has finished.
+func (s *Span) Duration() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.End.Sub(s.Start)
+}
+
+// Finish ends the span, recording err if the step failed, and exports it.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.End = time.Now()
+	s.Err = err
+	s.mutex.Unlock()
+
+	if e := currentExporter(); e != nil {
+		e.Export(s)
+	}
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// IDs only need to be unique enough to tell traces apart.
+		now := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(now >> uint(8*(i%8)))
+		}
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,18 @@
+package trace
+
+import (
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Trace Suite")
+}
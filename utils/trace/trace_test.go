@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// recorder is an exporter that keeps the spans it is given.
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) Export(span *Span) {
+	r.spans = append(r.spans, span)
+}
+
+var _ = Describe("Tracing", func() {
+	AfterEach(func() {
+		SetExporter(nil)
+	})
+
+	It("does nothing while there is no exporter", func() {
+		ctx, span := StartSpan(context.Background(), "CreateEndpoint", KindServer)
+		Expect(span).To(BeNil())
+		Expect(ctx).To(Equal(context.Background()))
+		span.SetAttribute("key", "value")
+		span.Finish(nil)
+	})
+
+	It("links child spans to their parent", func() {
+		r := &recorder{}
+		SetExporter(r)
+
+		ctx, parent := StartSpan(context.Background(), "CreateEndpoint", KindServer)
+		_, child := StartSpan(ctx, "datastore profile creation", KindClient)
+		child.Finish(errors.New("etcd unavailable"))
+		parent.Finish(nil)
+
+		Expect(r.spans).To(HaveLen(2))
+		Expect(child.TraceID).To(Equal(parent.TraceID))
+		Expect(child.ParentSpanID).To(Equal(parent.SpanID))
+		Expect(parent.ParentSpanID).To(BeEmpty())
+		Expect(child.Err).To(HaveOccurred())
+		Expect(child.End).NotTo(BeTemporally("<", child.Start))
+	})
+
+	Describe("OTLP exporter", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "trace")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		record := func(e *OTLPExporter) {
+			SetExporter(e)
+			ctx, parent := StartSpan(context.Background(), "CreateEndpoint", KindServer)
+			parent.SetAttribute("correlation_id", "ep1")
+			_, child := StartSpan(ctx, "Docker network inspection", KindClient)
+			child.Finish(errors.New("timed out"))
+			parent.Finish(nil)
+			e.flush()
+		}
+
+		checkRequest := func(data []byte) {
+			var req otlpRequest
+			Expect(json.Unmarshal(data, &req)).To(Succeed())
+			Expect(req.ResourceSpans).To(HaveLen(1))
+			Expect(req.ResourceSpans[0].Resource.Attributes).To(ContainElement(attribute("service.name", serviceName)))
+			spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[0].Name).To(Equal("Docker network inspection"))
+			Expect(spans[0].Status.Code).To(Equal(statusCodeError))
+			Expect(spans[0].TraceID).To(HaveLen(32))
+			Expect(spans[0].SpanID).To(HaveLen(16))
+			Expect(spans[1].Kind).To(Equal(KindServer))
+			Expect(spans[1].Attributes).To(Equal([]otlpAttribute{attribute("correlation_id", "ep1")}))
+			Expect(spans[1].StartTimeUnixNano).To(MatchRegexp(`^[0-9]+$`))
+		}
+
+		It("appends export requests to a file", func() {
+			path := filepath.Join(dir, "spans.json")
+			e, err := NewFileExporter(path)
+			Expect(err).NotTo(HaveOccurred())
+			record(e)
+			record(e)
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			Expect(lines).To(HaveLen(2))
+			checkRequest([]byte(lines[0]))
+		})
+
+		It("posts export requests to a collector", func() {
+			received := make(chan []byte, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				data, err := ioutil.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				received <- data
+			}))
+			defer server.Close()
+
+			record(NewHTTPExporter(server.URL + "/v1/traces"))
+			checkRequest(<-received)
+		})
+	})
+})